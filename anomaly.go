@@ -0,0 +1,283 @@
+// Anomaly detection over the requests of each device, alerting the home owner device when a device deviates from its baseline
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Kinds of anomalies, sent as detail of the owner alert
+const (
+	ANOMALY_RATE          = iota // The device sends far more requests than it used to
+	ANOMALY_ACCESS_TYPE          // The device requests an access type it rarely or never requested before
+	ANOMALY_TIME_OF_DAY          // The device sends a request at an hour it is rarely or never active at
+	ANOMALY_BAD_MAC              // Burst of requests with bad MAC tags, e.g. a forgery attempt
+	ANOMALY_STALE_COUNTER        // Burst of requests with stale counters, e.g. a replay attempt
+)
+
+var ANOMALY_NAMES []string = []string{"rate", "access type", "time of day", "bad MAC", "stale counter"}
+
+// Thresholds of the detector. Zero values disable the respective check:
+//
+//	{
+//	  "learningRequests": 200,
+//	  "window": "1m", "rateFactor": 5, "minWindowRequests": 10,
+//	  "rareAccessType": 0.01, "rareHour": 0.005,
+//	  "failureWindow": "1m", "maxBadMacs": 3, "maxStaleCounters": 5,
+//	  "cooldown": "10m", "history": 100
+//	}
+//
+// The baseline checks (rate, access type, time of day) only alert once a device sent learningRequests authentic requests.
+// An access type or hour is rare if its share of the device's requests so far is below the threshold
+type AnomalyConfig struct {
+	LearningRequests  uint64  `json:"learningRequests"`
+	Window            string  `json:"window"`            // Go duration, sliding window the current request rate is measured over
+	RateFactor        float64 `json:"rateFactor"`        // Alert if the window holds more than rateFactor times the requests the baseline rate predicts
+	MinWindowRequests int     `json:"minWindowRequests"` // ... and at least this many
+	RareAccessType    float64 `json:"rareAccessType"`
+	RareHour          float64 `json:"rareHour"`
+	FailureWindow     string  `json:"failureWindow"` // Go duration, sliding window bad MAC tags and stale counters are counted over
+	MaxBadMacs        int     `json:"maxBadMacs"`
+	MaxStaleCounters  int     `json:"maxStaleCounters"`
+	Cooldown          string  `json:"cooldown"` // Go duration, minimum time between two alerts of the same kind for the same device
+	History           int     `json:"history"`  // Number of anomalies kept for the console, 0 ==> 100
+
+	window        time.Duration
+	failureWindow time.Duration
+	cooldown      time.Duration
+}
+
+type Anomaly struct {
+	Id     uint32
+	Time   time.Time
+	DevId  uint32
+	Kind   uint8
+	Detail string
+}
+
+// What the detector learned about a single device
+type deviceBaseline struct {
+	firstSeen   time.Time
+	total       uint64
+	accessTypes map[uint16]uint64
+	hours       [24]uint64
+
+	recent        []time.Time // Arrival times of the authentic requests within the window
+	badMacs       []time.Time // Arrival times of the requests with bad MAC tags within the failure window
+	staleCounters []time.Time // Arrival times of the requests with stale counters within the failure window
+	lastAlert     map[uint8]time.Time
+}
+
+type AnomalyDetector struct {
+	mu        sync.Mutex
+	config    *AnomalyConfig
+	baselines map[uint32]*deviceBaseline
+	anomalies []Anomaly // Most recent last
+	nextId    uint32
+}
+
+func loadAnomalyConfig(path string) (*AnomalyDetector, error) {
+
+	// (1) Read and parse the configuration file
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &AnomalyConfig{}
+	err = json.Unmarshal(raw, config)
+	if err != nil {
+		return nil, &InvalidAnomalyConfig{Path: path, Reason: err.Error()}
+	}
+
+	// (2) Resolve the durations. Each is required by the checks using it
+	config.window, err = parseOptionalDuration(path, config.Window, config.RateFactor > 0)
+	if err != nil {
+		return nil, err
+	}
+	config.failureWindow, err = parseOptionalDuration(path, config.FailureWindow, config.MaxBadMacs > 0 || config.MaxStaleCounters > 0)
+	if err != nil {
+		return nil, err
+	}
+	config.cooldown, err = parseOptionalDuration(path, config.Cooldown, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.History <= 0 {
+		config.History = 100
+	}
+
+	return &AnomalyDetector{config: config, baselines: make(map[uint32]*deviceBaseline)}, nil
+}
+
+func parseOptionalDuration(path string, duration string, required bool) (time.Duration, error) {
+	if duration == "" && !required {
+		return 0, nil
+	}
+	parsed, err := time.ParseDuration(duration)
+	if err != nil || parsed <= 0 {
+		return 0, &InvalidAnomalyConfig{Path: path, Reason: "invalid duration \"" + duration + "\""}
+	}
+	return parsed, nil
+}
+
+// Returns the baseline of the device, creating it as needed. The caller must hold the lock
+func (d *AnomalyDetector) baselineOf(devId uint32, now time.Time) *deviceBaseline {
+	baseline, exists := d.baselines[devId]
+	if !exists {
+		baseline = &deviceBaseline{firstSeen: now, accessTypes: make(map[uint16]uint64), lastAlert: make(map[uint8]time.Time)}
+		d.baselines[devId] = baseline
+	}
+	return baseline
+}
+
+// Drops the times older than the window and appends now
+func slide(times []time.Time, window time.Duration, now time.Time) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > window {
+		i++
+	}
+	return append(times[i:], now)
+}
+
+// Records the anomaly unless one of the same kind was raised for the device within the cooldown. The caller must hold the lock
+func (d *AnomalyDetector) raise(baseline *deviceBaseline, devId uint32, kind uint8, detail string, now time.Time, raised []Anomaly) []Anomaly {
+	if last, exists := baseline.lastAlert[kind]; exists && now.Sub(last) < d.config.cooldown {
+		return raised
+	}
+	baseline.lastAlert[kind] = now
+
+	anomaly := Anomaly{Id: d.nextId, Time: now, DevId: devId, Kind: kind, Detail: detail}
+	d.nextId += 1
+
+	d.anomalies = append(d.anomalies, anomaly)
+	if len(d.anomalies) > d.config.History {
+		d.anomalies = d.anomalies[len(d.anomalies)-d.config.History:]
+	}
+
+	return append(raised, anomaly)
+}
+
+// Checks an authentic request against the device's baseline, then learns from it. Returns the anomalies raised. A nil detector raises none
+func (d *AnomalyDetector) observe(devId uint32, accessType uint16, now time.Time) []Anomaly {
+	if d == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	config := d.config
+	baseline := d.baselineOf(devId, now)
+	hour := now.Hour()
+
+	var raised []Anomaly
+
+	if config.RateFactor > 0 {
+		baseline.recent = slide(baseline.recent, config.window, now)
+	}
+
+	// (1) Check against the baseline, once it has been learned
+	if baseline.total >= config.LearningRequests && baseline.total > 0 {
+
+		// (1.1) Request rate
+		if config.RateFactor > 0 {
+			expected := float64(baseline.total) / now.Sub(baseline.firstSeen).Seconds() * config.window.Seconds()
+			if len(baseline.recent) >= config.MinWindowRequests && float64(len(baseline.recent)) > config.RateFactor*expected {
+				raised = d.raise(baseline, devId, ANOMALY_RATE, fmt.Sprintf("%v requests within %v, baseline predicts %.1f", len(baseline.recent), config.window, expected), now, raised)
+			}
+		}
+
+		// (1.2) Access-type mix
+		if share := float64(baseline.accessTypes[accessType]) / float64(baseline.total); share < config.RareAccessType {
+			raised = d.raise(baseline, devId, ANOMALY_ACCESS_TYPE, fmt.Sprintf("access type %v has a share of %.3f", accessType, share), now, raised)
+		}
+
+		// (1.3) Time of day
+		if share := float64(baseline.hours[hour]) / float64(baseline.total); share < config.RareHour {
+			raised = d.raise(baseline, devId, ANOMALY_TIME_OF_DAY, fmt.Sprintf("hour %v has a share of %.3f", hour, share), now, raised)
+		}
+	}
+
+	// (2) Learn from the request
+	baseline.total += 1
+	baseline.accessTypes[accessType] += 1
+	baseline.hours[hour] += 1
+
+	return raised
+}
+
+// Counts a request of the device which failed the freshness (ANOMALY_STALE_COUNTER) or authenticity (ANOMALY_BAD_MAC) check. Returns the anomalies raised
+func (d *AnomalyDetector) observeFailure(devId uint32, kind uint8, now time.Time) []Anomaly {
+	if d == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	config := d.config
+	baseline := d.baselineOf(devId, now)
+
+	var raised []Anomaly
+
+	switch kind {
+	case ANOMALY_BAD_MAC:
+		if config.MaxBadMacs > 0 {
+			baseline.badMacs = slide(baseline.badMacs, config.failureWindow, now)
+			if len(baseline.badMacs) > config.MaxBadMacs {
+				raised = d.raise(baseline, devId, kind, fmt.Sprintf("%v bad MAC tags within %v", len(baseline.badMacs), config.failureWindow), now, raised)
+			}
+		}
+	case ANOMALY_STALE_COUNTER:
+		if config.MaxStaleCounters > 0 {
+			baseline.staleCounters = slide(baseline.staleCounters, config.failureWindow, now)
+			if len(baseline.staleCounters) > config.MaxStaleCounters {
+				raised = d.raise(baseline, devId, kind, fmt.Sprintf("%v stale counters within %v", len(baseline.staleCounters), config.failureWindow), now, raised)
+			}
+		}
+	}
+
+	return raised
+}
+
+// Logs the anomalies and alerts the home owner device of them, if one exists
+func reportAnomalies(audit *Auditor, anomalies []Anomaly, ownerState *DeviceState) {
+	for _, anomaly := range anomalies {
+		fmt.Println("WARNING, anomaly: Device", anomaly.DevId, "deviates in", ANOMALY_NAMES[anomaly.Kind]+":", anomaly.Detail)
+		audit.record(AUDIT_ANOMALY, auditDevice(anomaly.DevId), AuditSource{}, ANOMALY_NAMES[anomaly.Kind]+": "+anomaly.Detail)
+		if ownerState != nil {
+			sendOwnerAlert(ownerState, OWNER_KIND_ANOMALY, anomaly.Id, anomaly.DevId, uint16(anomaly.Kind))
+		}
+	}
+}
+
+// Drops the device's baseline. A nil detector holds none
+func (d *AnomalyDetector) forget(devId uint32) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.baselines, devId)
+}
+
+// Prints the recent anomalies to the console, of all devices if all is set
+func (d *AnomalyDetector) printRecent(devId uint32, all bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fmt.Println("CONSOLE: - - - - - Recent anomalies - - - - -")
+	for _, anomaly := range d.anomalies {
+		if !all && anomaly.DevId != devId {
+			continue
+		}
+		fmt.Printf("Anomaly: %v, Device ID: %v, Kind: %v, Time: %v, Detail: %v\n", anomaly.Id, anomaly.DevId, ANOMALY_NAMES[anomaly.Kind], anomaly.Time.Format(time.RFC3339), anomaly.Detail)
+	}
+}
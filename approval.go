@@ -0,0 +1,39 @@
+// Write requests, e.g. to actuators, parked until the home owner device approves or denies them
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type ParkedRequest struct {
+	Ticket     uint32
+	DevId      uint32
+	AuthReq    AuthReq
+	LogSeq     uint64      // Sequence number of the request's entry in the device's log
+	Delegation *Delegation // Delegation the request uses, nil if none
+	ParkedAt   time.Time
+}
+
+type ParkedRequests map[uint32]ParkedRequest // Keyed by ticket
+
+// Parks the request under a fresh ticket, alerts the home owner device and arms the timeout which reports the ticket on timeoutChan
+func (p ParkedRequests) park(ticket uint32, authReq AuthReq, logSeq uint64, delegation *Delegation, ownerState *DeviceState, timeout time.Duration, timeoutChan chan uint32) {
+	p[ticket] = ParkedRequest{Ticket: ticket, DevId: authReq.DevId, AuthReq: authReq, LogSeq: logSeq, Delegation: delegation, ParkedAt: time.Now()}
+
+	fmt.Println("INFO, approval: Parked access type", authReq.AccessType, "of device", authReq.DevId, "under ticket", ticket, "==> Asking home owner device", ownerState.Id)
+	sendOwnerAlert(ownerState, OWNER_KIND_ACCESS, ticket, authReq.DevId, authReq.AccessType)
+
+	time.AfterFunc(timeout, func() {
+		timeoutChan <- ticket
+	})
+}
+
+// Removes the parked request and returns it, the flag is unset if the ticket is unknown (e.g. already decided)
+func (p ParkedRequests) take(ticket uint32) (ParkedRequest, bool) {
+	parked, exists := p[ticket]
+	if exists {
+		delete(p, ticket)
+	}
+	return parked, exists
+}
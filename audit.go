@@ -0,0 +1,273 @@
+// Audit trail of security events, e.g. forged, replayed or malformed messages, kept apart from the debug output such that attacks against the server can be reviewed
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const AUDIT_HISTORY = 100 // Number of events kept for the console
+
+// Severities of the events
+const (
+	AUDIT_INFO     = iota // Expected in normal operation, e.g. a signup rejected because the queue is full
+	AUDIT_WARNING         // Possibly an attack, e.g. a replayed request, but also caused by faulty gateways
+	AUDIT_CRITICAL        // Likely an attack, e.g. a forged MAC tag
+)
+
+var AUDIT_SEVERITY_NAMES []string = []string{"info", "warning", "critical"}
+
+// Kinds of events
+const (
+	AUDIT_MALFORMED_FRAME     = iota // Header or payload which cannot be parsed
+	AUDIT_UNKNOWN_DEVICE             // Message of a device ID which does not exist
+	AUDIT_BAD_MAC                    // Message whose MAC tag is not authentic
+	AUDIT_STALE_COUNTER              // Message whose counters are older than the device's, e.g. a replay
+	AUDIT_SIGNUP_WITHOUT_SCAN        // Signup of a static public key which was never scanned
+	AUDIT_SIGNUP_REJECTED            // Signup rejected, e.g. of an unknown device type
+	AUDIT_NOT_OWNER                  // Owner decision or delegation sent by a device other than the home owner device
+	AUDIT_ANOMALY                    // Device deviating from its baseline, see anomaly.go
+	AUDIT_LOG_TAMPERED               // Log whose hash chain or checkpoints do not verify, see logchain.go
+	AUDIT_REVOKED_DEVICE             // Message of a revoked device
+)
+
+var AUDIT_KIND_NAMES []string = []string{"malformed frame", "unknown device", "bad MAC", "stale counter", "signup without scan", "signup rejected", "not owner", "anomaly", "log tampered", "revoked device"}
+
+var AUDIT_SEVERITIES []uint8 = []uint8{AUDIT_WARNING, AUDIT_WARNING, AUDIT_CRITICAL, AUDIT_WARNING, AUDIT_WARNING, AUDIT_INFO, AUDIT_CRITICAL, AUDIT_WARNING, AUDIT_CRITICAL, AUDIT_WARNING}
+
+// Connection a message arrived on
+type AuditSource struct {
+	ConnId     uint32 `json:"connId"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+}
+
+type AuditEvent struct {
+	Time     time.Time
+	Kind     uint8
+	Severity uint8
+	DevId    *uint32 // Device the message claims to be from, nil if it carries none
+	Source   AuditSource
+	Details  string
+	PrevHash []byte // Hash of the previous event, nil for the first one
+	Hash     []byte // Over the JSON encoding of the event without the hash itself, see auditHash
+}
+
+// JSON encoding of an event, with the kind and severity by name such that the audit file can be read without this source
+type auditEventJSON struct {
+	Time     time.Time   `json:"time"`
+	Kind     string      `json:"kind"`
+	Severity string      `json:"severity"`
+	DevId    *uint32     `json:"devId,omitempty"`
+	Source   AuditSource `json:"source"`
+	Details  string      `json:"details,omitempty"`
+	PrevHash []byte      `json:"prevHash,omitempty"`
+	Hash     []byte      `json:"hash,omitempty"`
+}
+
+func (e AuditEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal(auditEventJSON{e.Time, AUDIT_KIND_NAMES[e.Kind], AUDIT_SEVERITY_NAMES[e.Severity], e.DevId, e.Source, e.Details, e.PrevHash, e.Hash})
+}
+
+func (e *AuditEvent) UnmarshalJSON(data []byte) error {
+	var decoded auditEventJSON
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+
+	*e = AuditEvent{Time: decoded.Time, DevId: decoded.DevId, Source: decoded.Source, Details: decoded.Details, PrevHash: decoded.PrevHash, Hash: decoded.Hash}
+	e.Kind, err = nameIndex(AUDIT_KIND_NAMES, decoded.Kind)
+	if err != nil {
+		return err
+	}
+	e.Severity, err = nameIndex(AUDIT_SEVERITY_NAMES, decoded.Severity)
+	return err
+}
+
+func nameIndex(names []string, name string) (uint8, error) {
+	for i := range names {
+		if names[i] == name {
+			return uint8(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown audit name \"%s\"", name)
+}
+
+// Hash of the event, chaining it to its predecessor by PrevHash
+func auditHash(event AuditEvent) []byte {
+	event.Hash = nil
+	encoded, err := json.Marshal(event)
+	checkSuccessString("audit, encoding event", err)
+	hash := sha256.Sum256(encoded)
+	return hash[:]
+}
+
+// Destination of the events, e.g. a file or a SIEM
+type AuditSink interface {
+	Emit(event AuditEvent) error
+}
+
+// Sink whose events can be read back, such that their hash chain can be verified
+type AuditReplayer interface {
+	Replay(fn func(event AuditEvent) bool) error
+}
+
+// Appends the events as JSON lines to a file
+type FileAuditSink struct {
+	file *os.File
+}
+
+func openFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{file: file}, nil
+}
+
+// Returns the hash of the last event in the file, nil if there is none, such that the chain continues across restarts
+func (s *FileAuditSink) lastHash() []byte {
+	var head []byte
+	s.Replay(func(event AuditEvent) bool {
+		head = event.Hash
+		return true
+	})
+	return head
+}
+
+// Runs fn on the events in the file in order until fn returns false
+func (s *FileAuditSink) Replay(fn func(event AuditEvent) bool) error {
+	file, err := os.Open(s.file.Name())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event AuditEvent
+		err = json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			return err
+		}
+		if !fn(event) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *FileAuditSink) Emit(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+type Auditor struct {
+	mu     sync.Mutex
+	sinks  []AuditSink
+	recent []AuditEvent // Most recent last
+	head   []byte       // Hash of the last event
+}
+
+// Creates the auditor. head is the hash of the last event recorded before, e.g. read from the audit file by lastHash
+func newAuditor(head []byte, sinks ...AuditSink) *Auditor {
+	return &Auditor{sinks: sinks, head: head}
+}
+
+// Returns the connection's ID and remote address
+func sourceOf(conn *net.TCPConn, connId uint32) AuditSource {
+	source := AuditSource{ConnId: connId}
+	if conn != nil {
+		source.RemoteAddr = conn.RemoteAddr().String()
+	}
+	return source
+}
+
+// Returns a reference to the device ID for AuditEvent.DevId
+func auditDevice(devId uint32) *uint32 {
+	return &devId
+}
+
+// Records an event of the kind and emits it to every sink. A nil auditor drops the event
+func (a *Auditor) record(kind uint8, devId *uint32, source AuditSource, details string) {
+	if a == nil {
+		return
+	}
+
+	event := AuditEvent{Time: time.Now(), Kind: kind, Severity: AUDIT_SEVERITIES[kind], DevId: devId, Source: source, Details: details}
+
+	// NOTE: Emitted under the lock, such that every sink sees the events in the same order
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	event.PrevHash = a.head
+	event.Hash = auditHash(event)
+	a.head = event.Hash
+
+	a.recent = append(a.recent, event)
+	if len(a.recent) > AUDIT_HISTORY {
+		a.recent = a.recent[len(a.recent)-AUDIT_HISTORY:]
+	}
+
+	for _, sink := range a.sinks {
+		checkSuccessString("audit, emitting event", sink.Emit(event))
+	}
+}
+
+// Checks the hash chain of the events of every sink which can replay them. Returns false if any is broken
+func (a *Auditor) verify() bool {
+	intact := true
+	for _, sink := range a.sinks {
+		replayer, ok := sink.(AuditReplayer)
+		if !ok {
+			continue
+		}
+
+		var count int
+		var prev []byte
+		err := replayer.Replay(func(event AuditEvent) bool {
+			if !bytes.Equal(auditHash(event), event.Hash) || (count > 0 && !bytes.Equal(prev, event.PrevHash)) {
+				fmt.Println("CONSOLE, Warning: Audit event", count, "at", event.Time.Format(time.RFC3339Nano), "does not match its hash or its predecessor's")
+				intact = false
+			}
+			prev = event.Hash
+			count += 1
+			return true
+		})
+		if !checkSuccessString("CONSOLE, replaying audit events", err) {
+			intact = false
+		}
+		fmt.Printf("CONSOLE: Audit trail: %v events checked ==> Intact: %v\n", count, intact)
+	}
+	return intact
+}
+
+// Prints the recent events of at least the severity to the console
+func (a *Auditor) printRecent(minSeverity uint8) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fmt.Println("CONSOLE: - - - - - Recent audit events - - - - -")
+	for _, event := range a.recent {
+		if event.Severity < minSeverity {
+			continue
+		}
+		device := "-"
+		if event.DevId != nil {
+			device = fmt.Sprint(*event.DevId)
+		}
+		fmt.Printf("Time: %v, Severity: %v, Kind: %v, Device ID: %v, Connection: %v (%v), Details: %v\n", event.Time.Format(time.RFC3339), AUDIT_SEVERITY_NAMES[event.Severity], AUDIT_KIND_NAMES[event.Kind], device, event.Source.ConnId, event.Source.RemoteAddr, event.Details)
+	}
+}
@@ -0,0 +1,81 @@
+// Authorization of fresh and authentic requests. Every check has to grant the request, the first denial decides
+package main
+
+import "time"
+
+// Returns the decision, the reason code and the delegation the request uses, nil if none
+func authorize(cfg *Config, devices *DeviceRegistry, devState *DeviceState, accessType uint16, arrival time.Time) (uint8, uint8, *Delegation) {
+
+	// (1) Devices awaiting approval by the home owner device or suspended by the admin may not do anything
+	if devState.Pending {
+		return DECISION_DENY, REASON_PENDING_APPROVAL, nil
+	}
+	if devState.Status == DEVICE_SUSPENDED {
+		return DECISION_DENY, REASON_SUSPENDED, nil
+	}
+
+	// (2) A delegation of another device's access type replaces the checks of (3) and (4), as the device uses the grantor's access type, not its own.
+	//	   The remaining checks protect the grantor's actuator ==> They match the grantor, not the device
+	actuatorState := devState
+	delegation, delegated := cfg.Delegations.active(devState.Id, accessType, arrival)
+	if delegated {
+		grantorState, exists := devices.get(delegation.Grantor)
+		if !exists {
+			// Case: Grantor deleted meanwhile, its delegations end with it
+			delegation, delegated = nil, false
+		} else {
+			actuatorState = &grantorState
+		}
+	}
+
+	if !delegated {
+		decision, reason := authorizeOwn(cfg, devState, accessType)
+		if decision == DECISION_DENY {
+			return decision, reason, nil
+		}
+	}
+
+	// (5) Schedules restrict when the granted access types may be used
+	decision, reason := cfg.Policy.checkSchedules(actuatorState, accessType, arrival)
+	if decision == DECISION_DENY {
+		return decision, reason, delegation
+	}
+
+	// (6) Safety interlocks depend on what other devices did recently
+	decision, reason = cfg.Policy.checkInterlocks(devices, actuatorState, accessType, arrival)
+	if decision == DECISION_DENY {
+		return decision, reason, delegation
+	}
+
+	// (7) Rate limits are checked last, such that only requests which would otherwise be granted count against them. NOTE: The approval and
+	//	   the lease may still deny the request, the shard then refunds it, see AuthShard.refundRateLimit
+	decision, reason = cfg.RateLimiter.admit(actuatorState.Id, accessType, arrival)
+	if decision == DECISION_ALLOW && delegated {
+		reason = REASON_DELEGATED
+	}
+	return decision, reason, delegation
+}
+
+// Checks (3) and (4) for an access type of the device itself
+func authorizeOwn(cfg *Config, devState *DeviceState, accessType uint16) (uint8, uint8) {
+
+	// (3) The device type and the capability document declared by the device bound what it may ever do
+	decision, reason := cfg.DeviceTypes.permits(devState.Type, accessType)
+	if decision == DECISION_DENY {
+		return decision, reason
+	}
+
+	decision, reason = cfg.Capabilities.permits(devState, accessType)
+	if decision == DECISION_DENY {
+		return decision, reason
+	}
+
+	// (4) The policy of the deployment decides within those bounds. Where no rule matches, the device type's default policy takes precedence
+	decision, reason = cfg.Policy.decide(devState, accessType)
+	if reason == REASON_POLICY_DEFAULT || reason == REASON_NONE {
+		if devType, _ := cfg.DeviceTypes.lookup(devState.Type); devType != nil && devType.hasDefault {
+			decision, reason = devType.defaultDecision, REASON_TYPE_DEFAULT
+		}
+	}
+	return decision, reason
+}
@@ -0,0 +1,326 @@
+// Capability documents, resolved from the CapURI a device sends at signup and cached by the server
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_CAP_DOC_LEN    = 64 * 1024        // Upper bound on the size of a capability document
+	CAP_RETRY_INTERVAL = 30 * time.Second // Minimum time between two attempts to fetch a document which could not be fetched
+)
+
+// Capability document layout:
+//
+//	{
+//	  "accessTypes": ["SAMPLE_SENSOR_0", "CONTROL_ACTUATOR_0"]
+//	}
+//
+// Other fields are ignored. Rates are limited by the server's own configuration, see ratelimit.go
+type CapabilityDoc struct {
+	AccessTypes []string `json:"accessTypes"`
+
+	accessTypes []uint16 // Access type names resolved to their numerical values
+}
+
+// Envelope of a capability document signed by the device's manufacturer:
+//
+//	{
+//	  "document": "<base64 of the capability document>",
+//	  "signature": "<base64 of the Ed25519 signature over the decoded document>"
+//	}
+type SignedCapabilityDoc struct {
+	Document  string `json:"document"`
+	Signature string `json:"signature"`
+}
+
+// Resolves a capability URI of one scheme to the raw document
+type CapResolver interface {
+	Resolve(u *url.URL) ([]byte, error)
+}
+
+// Resolves file:///path/to/doc.json
+type FileCapResolver struct{}
+
+func (r *FileCapResolver) Resolve(u *url.URL) ([]byte, error) {
+	f, err := os.Open(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(io.LimitReader(f, MAX_CAP_DOC_LEN))
+}
+
+// Resolves http://host/path/to/doc.json
+type HttpCapResolver struct {
+	Client *http.Client
+}
+
+func (r *HttpCapResolver) Resolve(u *url.URL) ([]byte, error) {
+	resp, err := r.Client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned status %s", u.String(), resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, MAX_CAP_DOC_LEN))
+}
+
+// Documents are cached per URI and device type, because the device type decides which manufacturer keys are trusted
+type capKey struct {
+	uri     string
+	devType uint16
+}
+
+type capEntry struct {
+	doc         *CapabilityDoc
+	unverified  bool      // Set if the last fetched document failed signature verification. doc is nil in that case
+	fetched     time.Time // Time the current document was fetched
+	lastAttempt time.Time // Time of the last attempt to fetch the document, successful or not
+	fetching    bool      // Set while a fetch is in flight, such that at most one fetch per entry runs at a time
+}
+
+// Cache of capability documents keyed by URI and device type. Documents are fetched in the background, such that the processor never blocks on I/O
+type CapabilityCache struct {
+	mu        sync.Mutex
+	resolvers map[string]CapResolver // Keyed by URI scheme
+	refresh   time.Duration          // Age after which a cached document is fetched again
+	entries   map[capKey]*capEntry
+
+	manufacturerKeys map[uint16][]ed25519.PublicKey // Trusted manufacturer keys per device type, nil ==> documents are not required to be signed
+	fallback         []uint16                       // Access types granted to devices whose document failed verification
+}
+
+func newCapabilityCache(refresh time.Duration, client *http.Client, manufacturerKeys map[uint16][]ed25519.PublicKey, fallback []uint16) *CapabilityCache {
+	httpResolver := &HttpCapResolver{Client: client}
+
+	return &CapabilityCache{
+		resolvers: map[string]CapResolver{
+			"file":  &FileCapResolver{},
+			"http":  httpResolver,
+			"https": httpResolver,
+		},
+		refresh:          refresh,
+		entries:          make(map[capKey]*capEntry),
+		manufacturerKeys: manufacturerKeys,
+		fallback:         fallback,
+	}
+}
+
+// Manufacturer key file layout, mapping device types to hex encoded Ed25519 public keys:
+//
+//	{
+//	  "1": ["3d4017c3e843895a92b70aa74d1b7ebc9c982ccf2ec4968cc0cd55f12af4660c"],
+//	  "2": ["..."]
+//	}
+func loadManufacturerKeys(path string) (map[uint16][]ed25519.PublicKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var hexKeys map[string][]string
+	err = json.Unmarshal(raw, &hexKeys)
+	if err != nil {
+		return nil, &InvalidKeyFile{Path: path, Reason: err.Error()}
+	}
+
+	keys := make(map[uint16][]ed25519.PublicKey)
+	for devTypeString, hexKeyList := range hexKeys {
+		devType, err := strconv.ParseUint(devTypeString, 10, 16)
+		if err != nil {
+			return nil, &InvalidKeyFile{Path: path, Reason: "invalid device type \"" + devTypeString + "\""}
+		}
+
+		for _, hexKey := range hexKeyList {
+			key, err := hex.DecodeString(hexKey)
+			if err != nil || len(key) != ed25519.PublicKeySize {
+				return nil, &InvalidKeyFile{Path: path, Reason: "invalid Ed25519 public key \"" + hexKey + "\""}
+			}
+			keys[uint16(devType)] = append(keys[uint16(devType)], ed25519.PublicKey(key))
+		}
+	}
+
+	return keys, nil
+}
+
+// Fetches, verifies and parses the document behind uri, bypassing the cache
+func (c *CapabilityCache) resolve(uri string, devType uint16) (*CapabilityDoc, error) {
+
+	// (1) Pick the resolver by scheme
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, &InvalidCapURI{URI: uri, Reason: err.Error()}
+	}
+
+	resolver, exists := c.resolvers[u.Scheme]
+	if !exists {
+		return nil, &InvalidCapURI{URI: uri, Reason: "unsupported scheme \"" + u.Scheme + "\""}
+	}
+
+	// (2) Fetch the raw document
+	raw, err := resolver.Resolve(u)
+	if err != nil {
+		return nil, err
+	}
+
+	// (3) Check the manufacturer's signature, if signatures are required
+	if c.manufacturerKeys != nil {
+		raw, err = c.verify(uri, devType, raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// (4) Parse the document and resolve the access type names
+	return parseCapabilityDoc(uri, raw)
+}
+
+// Checks the signature of the envelope against the keys trusted for devType and returns the signed document
+func (c *CapabilityCache) verify(uri string, devType uint16, raw []byte) ([]byte, error) {
+
+	// (1) Unpack the envelope
+	envelope := SignedCapabilityDoc{}
+	err := json.Unmarshal(raw, &envelope)
+	if err != nil {
+		return nil, &UnverifiedCapabilityDoc{URI: uri, DevType: devType, Reason: err.Error()}
+	}
+
+	doc, err := base64.StdEncoding.DecodeString(envelope.Document)
+	if err != nil {
+		return nil, &UnverifiedCapabilityDoc{URI: uri, DevType: devType, Reason: "document is not base64: " + err.Error()}
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(envelope.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return nil, &UnverifiedCapabilityDoc{URI: uri, DevType: devType, Reason: "missing or malformed signature"}
+	}
+
+	// (2) Any of the keys trusted for the device type may have signed the document
+	keys, exists := c.manufacturerKeys[devType]
+	if !exists {
+		return nil, &UnverifiedCapabilityDoc{URI: uri, DevType: devType, Reason: "no manufacturer key configured for device type"}
+	}
+
+	for _, key := range keys {
+		if ed25519.Verify(key, doc, signature) {
+			return doc, nil
+		}
+	}
+
+	return nil, &UnverifiedCapabilityDoc{URI: uri, DevType: devType, Reason: "signature does not verify under any trusted manufacturer key"}
+}
+
+func parseCapabilityDoc(uri string, raw []byte) (*CapabilityDoc, error) {
+	doc := &CapabilityDoc{}
+	err := json.Unmarshal(raw, doc)
+	if err != nil {
+		return nil, &InvalidCapabilityDoc{URI: uri, Reason: err.Error()}
+	}
+
+	doc.accessTypes = make([]uint16, len(doc.AccessTypes))
+	for i, name := range doc.AccessTypes {
+		accessType, exists := ACCESS_TYPE_NAMES[name]
+		if !exists {
+			return nil, &InvalidCapabilityDoc{URI: uri, Reason: "unknown access type \"" + name + "\""}
+		}
+		doc.accessTypes[i] = accessType
+	}
+
+	return doc, nil
+}
+
+func (c *CapabilityCache) fetch(key capKey) {
+	doc, err := c.resolve(key.uri, key.devType)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.entries[key]
+	entry.fetching = false
+	entry.lastAttempt = time.Now()
+
+	// A document failing verification replaces whatever was cached, the device is restricted to the fallback access types until a refresh verifies
+	if verifyErr, isVerifyErr := err.(*UnverifiedCapabilityDoc); isVerifyErr {
+		fmt.Println("WARNING, capabilities:", verifyErr.Error(), "==> Device restricted to fallback access types")
+		entry.doc = nil
+		entry.unverified = true
+		entry.fetched = entry.lastAttempt
+		return
+	}
+
+	// On any other failure, a previously fetched document stays in use until the next successful refresh
+	if !checkSuccessString("capabilities, fetching "+key.uri, err) {
+		return
+	}
+
+	entry.doc = doc
+	entry.unverified = false
+	entry.fetched = entry.lastAttempt
+	fmt.Println("DEBUG, capabilities: Fetched capability document from", key.uri+":", doc.AccessTypes)
+}
+
+// Returns the cached document for uri and devType, or nil if none has been fetched yet or it failed verification, which is signalled by the flag.
+// Starts a background fetch if the document is missing or stale
+func (c *CapabilityCache) lookup(uri string, devType uint16) (*CapabilityDoc, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := capKey{uri: uri, devType: devType}
+	entry, exists := c.entries[key]
+	if !exists {
+		entry = &capEntry{}
+		c.entries[key] = entry
+	}
+
+	fetchedOnce := entry.doc != nil || entry.unverified
+	stale := fetchedOnce && time.Since(entry.fetched) > c.refresh
+	missing := !fetchedOnce && time.Since(entry.lastAttempt) > CAP_RETRY_INTERVAL
+	if !entry.fetching && (stale || missing) {
+		entry.fetching = true
+		go c.fetch(key)
+	}
+
+	return entry.doc, entry.unverified
+}
+
+// Returns the decision and reason code for the access type given the device's capability document. A nil cache permits everything
+func (c *CapabilityCache) permits(devState *DeviceState, accessType uint16) (uint8, uint8) {
+	if c == nil {
+		return DECISION_ALLOW, REASON_NONE
+	}
+
+	doc, unverified := c.lookup(devState.CapURI, devState.Type)
+	if unverified {
+		if !containsUint16(c.fallback, accessType) {
+			return DECISION_DENY, REASON_CAPABILITY_UNVERIFIED
+		}
+		return DECISION_ALLOW, REASON_CAPABILITY_UNVERIFIED
+	}
+
+	if doc == nil {
+		return DECISION_DENY, REASON_CAPABILITY_MISSING
+	}
+
+	if !containsUint16(doc.accessTypes, accessType) {
+		return DECISION_DENY, REASON_CAPABILITY_UNDECLARED
+	}
+
+	return DECISION_ALLOW, REASON_NONE
+}
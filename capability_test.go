@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const TEST_DEV_TYPE = 1
+
+// Serves the capability document of /doc.json signed with the key, the document can be replaced while serving
+type capServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	envelope []byte
+}
+
+func newCapServer(t *testing.T) *capServer {
+	s := &capServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if r.URL.Path != "/doc.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(s.envelope)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *capServer) serve(t *testing.T, key ed25519.PrivateKey, doc string) {
+	envelope, err := json.Marshal(SignedCapabilityDoc{
+		Document:  base64.StdEncoding.EncodeToString([]byte(doc)),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(doc))),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.envelope = envelope
+}
+
+func newManufacturerKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+// Asks for the decision until it has the expected reason code, as documents are fetched in the background
+func awaitPermits(t *testing.T, cache *CapabilityCache, devState *DeviceState, accessType uint16, reason uint8) uint8 {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		decision, gotReason := cache.permits(devState, accessType)
+		if gotReason == reason {
+			return decision
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("access type %v: reason %v, expected %v", accessType, gotReason, reason)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCapabilityFetch(t *testing.T) {
+	pub, priv := newManufacturerKey(t)
+	server := newCapServer(t)
+	server.serve(t, priv, `{"accessTypes": ["SAMPLE_SENSOR_0"]}`)
+
+	cache := newCapabilityCache(time.Hour, server.Client(), map[uint16][]ed25519.PublicKey{TEST_DEV_TYPE: {pub}}, nil)
+	devState := &DeviceState{Id: 1, Type: TEST_DEV_TYPE, CapURI: server.URL + "/doc.json"}
+
+	// (1) Denied until the document is fetched
+	decision, reason := cache.permits(devState, SAMPLE_SENSOR_0)
+	if decision != DECISION_DENY || reason != REASON_CAPABILITY_MISSING {
+		t.Fatalf("before the fetch: decision %v, reason %v", decision, reason)
+	}
+
+	// (2) Declared access types are permitted, others are not
+	if awaitPermits(t, cache, devState, SAMPLE_SENSOR_0, REASON_NONE) != DECISION_ALLOW {
+		t.Fatal("declared access type denied")
+	}
+	decision, reason = cache.permits(devState, CONTROL_ACTUATOR_0)
+	if decision != DECISION_DENY || reason != REASON_CAPABILITY_UNDECLARED {
+		t.Fatalf("undeclared access type: decision %v, reason %v", decision, reason)
+	}
+}
+
+func TestCapabilityRefresh(t *testing.T) {
+	pub, priv := newManufacturerKey(t)
+	server := newCapServer(t)
+	server.serve(t, priv, `{"accessTypes": ["SAMPLE_SENSOR_0"]}`)
+
+	cache := newCapabilityCache(50*time.Millisecond, server.Client(), map[uint16][]ed25519.PublicKey{TEST_DEV_TYPE: {pub}}, nil)
+	devState := &DeviceState{Id: 1, Type: TEST_DEV_TYPE, CapURI: server.URL + "/doc.json"}
+	awaitPermits(t, cache, devState, SAMPLE_SENSOR_0, REASON_NONE)
+
+	// The replaced document is picked up once the cached one is stale
+	server.serve(t, priv, `{"accessTypes": ["CONTROL_ACTUATOR_0"]}`)
+	if awaitPermits(t, cache, devState, CONTROL_ACTUATOR_0, REASON_NONE) != DECISION_ALLOW {
+		t.Fatal("access type of the refreshed document denied")
+	}
+	decision, reason := cache.permits(devState, SAMPLE_SENSOR_0)
+	if decision != DECISION_DENY || reason != REASON_CAPABILITY_UNDECLARED {
+		t.Fatalf("access type of the replaced document: decision %v, reason %v", decision, reason)
+	}
+}
+
+func TestCapabilityBadSignature(t *testing.T) {
+	pub, _ := newManufacturerKey(t)
+	_, otherPriv := newManufacturerKey(t)
+	server := newCapServer(t)
+	server.serve(t, otherPriv, `{"accessTypes": ["SAMPLE_SENSOR_0", "CONTROL_ACTUATOR_0"]}`)
+
+	cache := newCapabilityCache(time.Hour, server.Client(), map[uint16][]ed25519.PublicKey{TEST_DEV_TYPE: {pub}}, []uint16{SAMPLE_SENSOR_0})
+	devState := &DeviceState{Id: 1, Type: TEST_DEV_TYPE, CapURI: server.URL + "/doc.json"}
+
+	// The device is restricted to the fallback access types, whatever the document declares
+	if awaitPermits(t, cache, devState, SAMPLE_SENSOR_0, REASON_CAPABILITY_UNVERIFIED) != DECISION_ALLOW {
+		t.Fatal("fallback access type denied")
+	}
+	decision, reason := cache.permits(devState, CONTROL_ACTUATOR_0)
+	if decision != DECISION_DENY || reason != REASON_CAPABILITY_UNVERIFIED {
+		t.Fatalf("access type outside the fallback: decision %v, reason %v", decision, reason)
+	}
+
+	// Devices of a type without trusted keys are restricted as well
+	otherType := &DeviceState{Id: 2, Type: TEST_DEV_TYPE + 1, CapURI: server.URL + "/doc.json"}
+	if awaitPermits(t, cache, otherType, CONTROL_ACTUATOR_0, REASON_CAPABILITY_UNVERIFIED) != DECISION_DENY {
+		t.Fatal("device type without trusted keys permitted")
+	}
+}
+
+func TestCapabilityPermitsWithoutCache(t *testing.T) {
+	var cache *CapabilityCache
+	decision, reason := cache.permits(&DeviceState{Id: 1}, CONTROL_ACTUATOR_0)
+	if decision != DECISION_ALLOW || reason != REASON_NONE {
+		t.Fatalf("nil cache: decision %v, reason %v", decision, reason)
+	}
+}
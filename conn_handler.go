@@ -9,7 +9,7 @@ import (
 	"strconv"
 )
 
-func connHandler(c *net.TCPConn, handlerId uint32, signupReqChan chan SignupReq, authReqChan chan AuthReq) {
+func connHandler(c *net.TCPConn, handlerId uint32, signupReqChan chan SignupReq, authReqChan chan AuthReq, ownerDecisionChan chan OwnerDecision, delegationChan chan DelegationReq, audit *Auditor) {
 	var err error
 
 	// Debugging variable, used in checkSuccessString and similar
@@ -38,6 +38,7 @@ func connHandler(c *net.TCPConn, handlerId uint32, signupReqChan chan SignupReq,
 		// (2) Parse header
 		header, err := parseHeader(headerBuf, handlerId)
 		if !checkSuccessString(handlerIdString, err) {
+			audit.record(AUDIT_MALFORMED_FRAME, nil, sourceOf(c, handlerId), err.Error())
 			continue
 		}
 
@@ -60,8 +61,10 @@ func connHandler(c *net.TCPConn, handlerId uint32, signupReqChan chan SignupReq,
 		}
 
 		// (4) Process payload (includes sending it to correct channel)
-		err = processPayload(payloadBuf, payloadType, c, signupReqChan, authReqChan, handlerId, handlerIdString)
-		checkSuccessString(handlerIdString, err)
+		err = processPayload(payloadBuf, payloadType, c, signupReqChan, authReqChan, ownerDecisionChan, delegationChan, handlerId, handlerIdString)
+		if !checkSuccessString(handlerIdString, err) {
+			audit.record(AUDIT_MALFORMED_FRAME, nil, sourceOf(c, handlerId), err.Error())
+		}
 
 	}
 
@@ -83,8 +86,8 @@ func parseHeader(headerBuf []byte, handlerId uint32) (Header, error) {
 	// (1.1) Extract payload type
 	var payloadType uint8 = headerBuf[0]
 
-	// (1.2) Check if payload type is expected. Note that we have only two inbound expected types: SIGNUP_REQ and AUTH_REQ. Any other value is either for outbound messages or just invalid
-	if (payloadType != PAYLOAD_AUTH_REQ) && (payloadType != PAYLOAD_SIGNUP_REQ) {
+	// (1.2) Check if payload type is expected. Note that we have only four inbound expected types: SIGNUP_REQ, AUTH_REQ, OWNER_DECISION and DELEGATION. Any other value is either for outbound messages or just invalid
+	if (payloadType != PAYLOAD_AUTH_REQ) && (payloadType != PAYLOAD_SIGNUP_REQ) && (payloadType != PAYLOAD_OWNER_DECISION) && (payloadType != PAYLOAD_DELEGATION) {
 		return Header{}, &InvalidPayloadType{HandlerId: handlerId, PayloadType: headerBuf[0]}
 	}
 
@@ -93,11 +96,13 @@ func parseHeader(headerBuf []byte, handlerId uint32) (Header, error) {
 	// (2.1) Extract payload length
 	var payloadLen uint16 = binary.LittleEndian.Uint16(headerBuf[1:])
 
-	// (2.2) Check payload length given payload type
-	// TODO: Change this such that PAYLOAD_SIGNUP is handled in a more graceful way
+	// (2.2) Check payload length given payload type. NOTE: The signup's length is a lower bound, the CapURI follows the fixed fields
 	if payloadType != PAYLOAD_SIGNUP_REQ && payloadLen != PAYLOAD_LENS[payloadType] {
 		return Header{}, &InvalidPayloadLen{HandlerId: handlerId, PayloadType: payloadType, PayloadLen: payloadLen}
 	}
+	if payloadType == PAYLOAD_SIGNUP_REQ && payloadLen < PAYLOAD_LENS[payloadType] {
+		return Header{}, &InvalidPayloadLen{HandlerId: handlerId, PayloadType: payloadType, PayloadLen: payloadLen}
+	}
 
 	// (3) Return Header VALUE (==> No pointer) and no error (==> nil pointer)
 	return Header{PayloadType: payloadType, PayloadLen: payloadLen}, nil
@@ -105,7 +110,7 @@ func parseHeader(headerBuf []byte, handlerId uint32) (Header, error) {
 }
 
 // Parses the payload AND sends it to corresponding channel
-func processPayload(payloadBuf []byte, payloadType uint8, conn *net.TCPConn, signupReqChan chan SignupReq, authReqChan chan AuthReq, handlerId uint32, handlerIdString string) error {
+func processPayload(payloadBuf []byte, payloadType uint8, conn *net.TCPConn, signupReqChan chan SignupReq, authReqChan chan AuthReq, ownerDecisionChan chan OwnerDecision, delegationChan chan DelegationReq, handlerId uint32, handlerIdString string) error {
 	switch payloadType {
 	case PAYLOAD_SIGNUP_REQ:
 
@@ -117,7 +122,7 @@ func processPayload(payloadBuf []byte, payloadType uint8, conn *net.TCPConn, sig
 		macTag := payloadBuf[2+KEY_LEN+KEY_LEN : 2+KEY_LEN+KEY_LEN+HMAC_OUTPUT_SIZE]
 		capURI := payloadBuf[2+KEY_LEN+KEY_LEN+HMAC_OUTPUT_SIZE:]
 
-		signupReq := SignupReq{Conn: conn, DevType: binary.LittleEndian.Uint16(payloadBuf[0:2]), SPubGW: sPub, EPubGw: ePub, MacTag: macTag, CapURI: capURI}
+		signupReq := SignupReq{Conn: conn, ConnId: handlerId, DevType: binary.LittleEndian.Uint16(payloadBuf[0:2]), SPubGW: sPub, EPubGw: ePub, MacTag: macTag, CapURI: capURI}
 
 		signupReqChan <- signupReq
 		return nil
@@ -129,8 +134,30 @@ func processPayload(payloadBuf []byte, payloadType uint8, conn *net.TCPConn, sig
 		if err != nil { // If an error occurred, bubble it up
 			return err
 		}
+		authReq.Conn = conn
+		authReq.ConnId = handlerId
 		authReqChan <- authReq // Enqueue valid authentication request into its channel to then be processed by the processor task
 		return nil
+	case PAYLOAD_OWNER_DECISION:
+		fmt.Println("DEBUG, parsePayload of ", handlerIdString+": Received owner decision")
+
+		ownerDecision, err := parseOwnerDecision(payloadBuf, handlerId)
+		if err != nil {
+			return err
+		}
+		ownerDecision.Source = sourceOf(conn, handlerId)
+		ownerDecisionChan <- ownerDecision
+		return nil
+	case PAYLOAD_DELEGATION:
+		fmt.Println("DEBUG, parsePayload of ", handlerIdString+": Received delegation request")
+
+		delegationReq, err := parseDelegationReq(payloadBuf, handlerId)
+		if err != nil {
+			return err
+		}
+		delegationReq.Source = sourceOf(conn, handlerId)
+		delegationChan <- delegationReq
+		return nil
 	default:
 		return &NotYetImplementedPayloadType{HandlerId: handlerId, PayloadType: payloadType}
 	}
@@ -147,9 +174,49 @@ func parseAuthReq(payloadBuf []byte, handlerId uint32) (AuthReq, error) {
 		macTag     []byte = payloadBuf[DEVICE_ID_LEN+REB_CNT_LEN+REQ_CNT_LEN+ACCESS_TYPE_LEN:]
 	)
 
-	if (accessType < SAMPLE_SENSOR_0 || accessType > CONTROL_ACTUATOR_1) && accessType != DUMMY_REQUEST {
-		return AuthReq{}, &InvalidAccessType{HandlerId: handlerId, AccessType: accessType}
-	}
+	// NOTE: Whether the access type exists depends on the device's type, which is checked in the processor
 
 	return AuthReq{DevId: deviceId, AccessType: accessType, RebCnt: rebCnt, ReqCnt: reqCnt, MacTag: macTag}, nil
 }
+
+// Extract the fields of an owner decision and returns a corresponding struct
+func parseOwnerDecision(payloadBuf []byte, handlerId uint32) (OwnerDecision, error) {
+
+	var (
+		deviceId uint32 = binary.LittleEndian.Uint32(payloadBuf)
+		rebCnt   uint32 = binary.LittleEndian.Uint32(payloadBuf[DEVICE_ID_LEN:])
+		reqCnt   uint32 = binary.LittleEndian.Uint32(payloadBuf[DEVICE_ID_LEN+REB_CNT_LEN:])
+		kind     uint8  = payloadBuf[DEVICE_ID_LEN+REB_CNT_LEN+REQ_CNT_LEN]
+		ticket   uint32 = binary.LittleEndian.Uint32(payloadBuf[DEVICE_ID_LEN+REB_CNT_LEN+REQ_CNT_LEN+OWNER_KIND_LEN:])
+		decision uint8  = payloadBuf[DEVICE_ID_LEN+REB_CNT_LEN+REQ_CNT_LEN+OWNER_KIND_LEN+TICKET_LEN]
+		macTag   []byte = payloadBuf[DEVICE_ID_LEN+REB_CNT_LEN+REQ_CNT_LEN+OWNER_KIND_LEN+TICKET_LEN+DECISION_LEN:]
+	)
+
+	if (kind != OWNER_KIND_SIGNUP && kind != OWNER_KIND_ACCESS) || (decision != DECISION_DENY && decision != DECISION_ALLOW) {
+		return OwnerDecision{}, &InvalidOwnerDecision{HandlerId: handlerId, Kind: kind, Decision: decision}
+	}
+
+	return OwnerDecision{DevId: deviceId, RebCnt: rebCnt, ReqCnt: reqCnt, Kind: kind, Ticket: ticket, Decision: decision, MacTag: macTag}, nil
+}
+
+// Extract the fields of a delegation request and returns a corresponding struct
+func parseDelegationReq(payloadBuf []byte, handlerId uint32) (DelegationReq, error) {
+
+	var (
+		deviceId   uint32 = binary.LittleEndian.Uint32(payloadBuf)
+		rebCnt     uint32 = binary.LittleEndian.Uint32(payloadBuf[DEVICE_ID_LEN:])
+		reqCnt     uint32 = binary.LittleEndian.Uint32(payloadBuf[DEVICE_ID_LEN+REB_CNT_LEN:])
+		op         uint8  = payloadBuf[DEVICE_ID_LEN+REB_CNT_LEN+REQ_CNT_LEN]
+		grantee    uint32 = binary.LittleEndian.Uint32(payloadBuf[DEVICE_ID_LEN+REB_CNT_LEN+REQ_CNT_LEN+DELEGATION_OP_LEN:])
+		grantor    uint32 = binary.LittleEndian.Uint32(payloadBuf[DEVICE_ID_LEN+REB_CNT_LEN+REQ_CNT_LEN+DELEGATION_OP_LEN+DEVICE_ID_LEN:])
+		accessType uint16 = binary.LittleEndian.Uint16(payloadBuf[DEVICE_ID_LEN+REB_CNT_LEN+REQ_CNT_LEN+DELEGATION_OP_LEN+DEVICE_ID_LEN+DEVICE_ID_LEN:])
+		expires    uint64 = binary.LittleEndian.Uint64(payloadBuf[DEVICE_ID_LEN+REB_CNT_LEN+REQ_CNT_LEN+DELEGATION_OP_LEN+DEVICE_ID_LEN+DEVICE_ID_LEN+ACCESS_TYPE_LEN:])
+		macTag     []byte = payloadBuf[DEVICE_ID_LEN+REB_CNT_LEN+REQ_CNT_LEN+DELEGATION_OP_LEN+DEVICE_ID_LEN+DEVICE_ID_LEN+ACCESS_TYPE_LEN+EXPIRES_LEN:]
+	)
+
+	if op != DELEGATION_OP_ISSUE && op != DELEGATION_OP_REVOKE {
+		return DelegationReq{}, &InvalidDelegationOp{HandlerId: handlerId, Op: op}
+	}
+
+	return DelegationReq{DevId: deviceId, RebCnt: rebCnt, ReqCnt: reqCnt, Op: op, Grantee: grantee, Grantor: grantor, AccessType: accessType, Expires: expires, MacTag: macTag}, nil
+}
@@ -3,13 +3,15 @@ package main
 import (
 	"bufio"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func consoleTask(sState *ServerState, scanChan chan Scan) {
+func consoleTask(cfg *Config, devices *DeviceRegistry, handshakes *HandshakePool, scanChan chan Scan, ownerChan chan uint32, releaseChan chan string, delegationChan chan DelegationReq, lifecycleChan chan LifecycleCmd) {
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Println("CONSOLE: Console task started")
 	fmt.Println("CONSOLE: ---------------------")
@@ -24,7 +26,7 @@ func consoleTask(sState *ServerState, scanChan chan Scan) {
 	copy(pskArray[:], psk)
 	fmt.Println("CONSOLE: Scan received successfully")
 
-	scanChan <- Scan{SPubGW: pubKeyArray, Psk: pskArray}
+	scanChan <- Scan{SPubGW: pubKeyArray, Psk: pskArray, Created: time.Now(), TTL: cfg.ScanTTL}
 
 	for {
 		resp, _ := reader.ReadString('\n')
@@ -35,9 +37,40 @@ func consoleTask(sState *ServerState, scanChan chan Scan) {
 
 		command := slicedResp[0]
 
-		if strings.Contains(command, "log") {
+		if strings.Contains(command, "verify-log") { // NOTE: Must be checked before "log", which it contains
+
+			// verify-log <device ID | audit>
 			if len(slicedResp) != 2 {
-				fmt.Printf("CONSOLE, Error: Entered command \"log\" has unexpected number of parameters (%v instead of expected 1)\n", len(slicedResp))
+				fmt.Printf("CONSOLE, Error: Entered command \"verify-log\" has unexpected number of parameters (%v instead of expected 1)\n", len(slicedResp))
+				continue
+			}
+
+			if slicedResp[1] == "audit" {
+				if cfg.Audit == nil {
+					fmt.Println("CONSOLE: The audit trail is not enabled")
+					continue
+				}
+				cfg.Audit.verify()
+				continue
+			}
+
+			devId, err := strconv.Atoi(slicedResp[1])
+			if !checkSuccessString("CONSOLE", err) {
+				continue
+			}
+
+			devState, devExists := devices.get(uint32(devId))
+			if !devExists {
+				fmt.Printf("CONSOLE, Warning: Device ID %v not found in Server State!\n", devId)
+				continue
+			}
+
+			devState.Log.verify(cfg.Audit)
+		} else if strings.Contains(command, "log") {
+
+			// log <device ID> [first index], without first index the latest page is printed
+			if len(slicedResp) != 2 && len(slicedResp) != 3 {
+				fmt.Printf("CONSOLE, Error: Entered command \"log\" has unexpected number of parameters (%v instead of expected 1 or 2)\n", len(slicedResp))
 				continue
 			}
 			devId, err := strconv.Atoi(slicedResp[1])
@@ -46,27 +79,64 @@ func consoleTask(sState *ServerState, scanChan chan Scan) {
 				continue
 			}
 
-			devState, devExists := (*sState)[uint32(devId)]
+			devState, devExists := devices.get(uint32(devId))
 
 			if !devExists {
 				fmt.Printf("CONSOLE, Warning: Device ID %v not found in Server State!\n", devId)
 				continue
 			}
 
-			logSlice := devState.Log
+			// Entries no longer in memory are read from the segment files
+			length := devState.Log.length()
+			var from uint64
+			if len(slicedResp) == 3 {
+				from, err = strconv.ParseUint(slicedResp[2], 10, 64)
+				if !checkSuccessString("CONSOLE", err) {
+					continue
+				}
+			} else if length > LOG_PAGE_SIZE {
+				from = length - LOG_PAGE_SIZE
+			}
+
+			logSlice := devState.Log.page(from, LOG_PAGE_SIZE)
+
+			fmt.Printf("CONSOLE: - - - - - LOG entries for device ID: %v, type: %v, status: %v, label: %q - - - - -\n", devId, cfg.DeviceTypes.name(devState.Type), DEVICE_STATUS_NAMES[devState.Status], devState.ScanData.Label)
 
-			fmt.Printf("CONSOLE: - - - - - LOG entries for device ID: %v - - - - -\n", devId)
+			for _, entry := range logSlice {
+				entry.prettyPrint(cfg.DeviceTypes.accessTypeName(devState.Type, entry.AuthReq.AccessType))
+			}
 
-			for i, entry := range logSlice {
-				entry.prettyPrint(i)
+			if from > 0 {
+				previous := uint64(0)
+				if from > LOG_PAGE_SIZE {
+					previous = from - LOG_PAGE_SIZE
+				}
+				fmt.Printf("CONSOLE: Previous page: log %v %v\n", devId, previous)
+			}
+			if from+LOG_PAGE_SIZE < length {
+				fmt.Printf("CONSOLE: Next page: log %v %v\n", devId, from+LOG_PAGE_SIZE)
 			}
 		} else if strings.Contains(command, "scan") {
 
-			if len(slicedResp) != 3 {
-				fmt.Printf("CONSOLE, Error: Entered command \"scan\" has unexpected number of parameters (%v instead of expected 2)\n", len(slicedResp))
+			// Usage: scan <pubKey> <psk> [ttl] [label], where a ttl of 0 never expires and the label may contain spaces
+			if len(slicedResp) < 3 {
+				fmt.Printf("CONSOLE, Error: Entered command \"scan\" has unexpected number of parameters (%v instead of expected at least 2)\n", len(slicedResp))
 				continue
 			}
 
+			ttl := cfg.ScanTTL
+			if len(slicedResp) > 3 {
+				var err error
+				ttl, err = time.ParseDuration(slicedResp[3])
+				if !checkSuccessString("SCAN ttl", err) {
+					continue
+				}
+			}
+			label := ""
+			if len(slicedResp) > 4 {
+				label = strings.Join(slicedResp[4:], " ")
+			}
+
 			pubKey, err := hex.DecodeString(slicedResp[1])
 			if !checkSuccessString("SCAN pubKey", err) {
 				continue
@@ -85,11 +155,254 @@ func consoleTask(sState *ServerState, scanChan chan Scan) {
 
 			// fmt.Printf("DEBUG, console: Scanned following data: %x", Scan{Psk: pskArray, SPubGW: pubKeyArray})
 
-			scanChan <- Scan{Psk: pskArray, SPubGW: pubKeyArray}
+			scanChan <- Scan{Psk: pskArray, SPubGW: pubKeyArray, Created: time.Now(), TTL: ttl, Label: label}
 			fmt.Println("CONSOLE: Scan received successfully")
+		} else if strings.Contains(command, "owner") {
+
+			if len(slicedResp) != 2 {
+				fmt.Printf("CONSOLE, Error: Entered command \"owner\" has unexpected number of parameters (%v instead of expected 1)\n", len(slicedResp))
+				continue
+			}
+
+			devId, err := strconv.Atoi(slicedResp[1])
+			if !checkSuccessString("CONSOLE", err) {
+				continue
+			}
+
+			ownerChan <- uint32(devId)
+			fmt.Println("CONSOLE: Home owner device designation forwarded to processor")
+		} else if strings.Contains(command, "rates") {
+
+			if len(slicedResp) != 2 {
+				fmt.Printf("CONSOLE, Error: Entered command \"rates\" has unexpected number of parameters (%v instead of expected 1)\n", len(slicedResp))
+				continue
+			}
+
+			devId, err := strconv.Atoi(slicedResp[1])
+			if !checkSuccessString("CONSOLE", err) {
+				continue
+			}
+
+			if cfg.RateLimiter == nil {
+				fmt.Println("CONSOLE: Rate limiting is not enabled")
+				continue
+			}
+
+			cfg.RateLimiter.printUsage(uint32(devId))
+		} else if strings.Contains(command, "release") { // NOTE: Must be checked before "lease", which it contains
+
+			if len(slicedResp) != 2 {
+				fmt.Printf("CONSOLE, Error: Entered command \"release\" has unexpected number of parameters (%v instead of expected 1)\n", len(slicedResp))
+				continue
+			}
+
+			releaseChan <- slicedResp[1]
+			fmt.Println("CONSOLE: Lease release forwarded to processor")
+		} else if strings.Contains(command, "lease") {
+
+			if cfg.Leases == nil {
+				fmt.Println("CONSOLE: Leases are not enabled")
+				continue
+			}
+
+			cfg.Leases.printLeases()
+		} else if strings.Contains(command, "signups") {
+
+			cfg.HeldSignups.printHeld(cfg.DeviceTypes)
+		} else if strings.Contains(command, "handshakes") {
+
+			handshakes.printMetrics()
+		} else if strings.Contains(command, "anomalies") {
+
+			// anomalies [device ID]
+			if len(slicedResp) > 2 {
+				fmt.Printf("CONSOLE, Error: Entered command \"anomalies\" has unexpected number of parameters (%v instead of expected 0 or 1)\n", len(slicedResp))
+				continue
+			}
+
+			if cfg.Anomalies == nil {
+				fmt.Println("CONSOLE: Anomaly detection is not enabled")
+				continue
+			}
+
+			if len(slicedResp) == 1 {
+				cfg.Anomalies.printRecent(0, true)
+				continue
+			}
+
+			devId, err := strconv.Atoi(slicedResp[1])
+			if !checkSuccessString("CONSOLE", err) {
+				continue
+			}
+
+			cfg.Anomalies.printRecent(uint32(devId), false)
+		} else if strings.Contains(command, "ungrant") { // NOTE: Must be checked before "grant", which it contains
+
+			if len(slicedResp) != 2 {
+				fmt.Printf("CONSOLE, Error: Entered command \"ungrant\" has unexpected number of parameters (%v instead of expected 1)\n", len(slicedResp))
+				continue
+			}
+
+			id, err := strconv.Atoi(slicedResp[1])
+			if !checkSuccessString("CONSOLE", err) {
+				continue
+			}
+
+			if cfg.Delegations.revoke(cfg.Store, uint32(id)) {
+				fmt.Println("CONSOLE: Delegation", id, "revoked")
+			} else {
+				fmt.Printf("CONSOLE, Warning: Delegation %v not found!\n", id)
+			}
+		} else if strings.Contains(command, "grants") { // NOTE: Must be checked before "grant", which it contains
+
+			if len(slicedResp) != 2 {
+				fmt.Printf("CONSOLE, Error: Entered command \"grants\" has unexpected number of parameters (%v instead of expected 1)\n", len(slicedResp))
+				continue
+			}
+
+			devId, err := strconv.Atoi(slicedResp[1])
+			if !checkSuccessString("CONSOLE", err) {
+				continue
+			}
+
+			cfg.Delegations.printFor(cfg.Store, uint32(devId))
+		} else if strings.Contains(command, "grant") {
+
+			// grant <grantee> <grantor> <access type name> <duration, e.g. 48h, or RFC 3339 expiry, e.g. 2026-10-25T23:59:00+02:00>
+			if len(slicedResp) != 5 {
+				fmt.Printf("CONSOLE, Error: Entered command \"grant\" has unexpected number of parameters (%v instead of expected 4)\n", len(slicedResp))
+				continue
+			}
+
+			grantee, err := strconv.Atoi(slicedResp[1])
+			if !checkSuccessString("CONSOLE", err) {
+				continue
+			}
+
+			grantor, err := strconv.Atoi(slicedResp[2])
+			if !checkSuccessString("CONSOLE", err) {
+				continue
+			}
+
+			accessType, exists := ACCESS_TYPE_NAMES[slicedResp[3]]
+			if !exists {
+				checkSuccessString("CONSOLE", &UnknownAccessTypeName{Name: slicedResp[3]})
+				continue
+			}
+
+			expires, err := parseExpiry(slicedResp[4])
+			if !checkSuccessString("CONSOLE", err) {
+				continue
+			}
+
+			delegationChan <- DelegationReq{Op: DELEGATION_OP_ISSUE, Grantee: uint32(grantee), Grantor: uint32(grantor), AccessType: accessType, Expires: uint64(expires.Unix())}
+			fmt.Println("CONSOLE: Delegation forwarded to processor")
+		} else if strings.Contains(command, "prove") {
+
+			// prove <device ID> <index>, prints the inclusion proof of the log entry for the home owner device
+			if len(slicedResp) != 3 {
+				fmt.Printf("CONSOLE, Error: Entered command \"prove\" has unexpected number of parameters (%v instead of expected 2)\n", len(slicedResp))
+				continue
+			}
+
+			devId, err := strconv.Atoi(slicedResp[1])
+			if !checkSuccessString("CONSOLE", err) {
+				continue
+			}
+
+			seq, err := strconv.ParseUint(slicedResp[2], 10, 64)
+			if !checkSuccessString("CONSOLE", err) {
+				continue
+			}
+
+			devState, devExists := devices.get(uint32(devId))
+			if !devExists {
+				fmt.Printf("CONSOLE, Warning: Device ID %v not found in Server State!\n", devId)
+				continue
+			}
+
+			var ownerState *DeviceState
+			devices.forEach(func(candidate *DeviceState) bool {
+				if candidate.Owner {
+					owner := *candidate
+					ownerState = &owner
+					return false
+				}
+				return true
+			})
+
+			proof, err := devState.Log.prove(seq, ownerState)
+			if !checkSuccessString("CONSOLE", err) {
+				continue
+			}
+
+			encoded, err := json.Marshal(proof)
+			if !checkSuccessString("CONSOLE", err) {
+				continue
+			}
+			fmt.Println("CONSOLE: Inclusion proof:", string(encoded))
+		} else if strings.Contains(command, "suspend") || strings.Contains(command, "resume") || strings.Contains(command, "revoke") || strings.Contains(command, "delete") {
+
+			// suspend | resume | revoke | delete <device ID>
+			if len(slicedResp) != 2 {
+				fmt.Printf("CONSOLE, Error: Entered command \"%s\" has unexpected number of parameters (%v instead of expected 1)\n", command, len(slicedResp))
+				continue
+			}
+
+			devId, err := strconv.Atoi(slicedResp[1])
+			if !checkSuccessString("CONSOLE", err) {
+				continue
+			}
+
+			var op uint8
+			for i, name := range LIFECYCLE_NAMES {
+				if strings.Contains(command, name) {
+					op = uint8(i)
+				}
+			}
+
+			lifecycleChan <- LifecycleCmd{Op: op, DevId: uint32(devId)}
+			fmt.Println("CONSOLE: Lifecycle operation forwarded to processor")
+		} else if strings.Contains(command, "audit") {
+
+			// audit [info | warning | critical], the minimum severity of the printed events
+			if len(slicedResp) > 2 {
+				fmt.Printf("CONSOLE, Error: Entered command \"audit\" has unexpected number of parameters (%v instead of expected 0 or 1)\n", len(slicedResp))
+				continue
+			}
+
+			if cfg.Audit == nil {
+				fmt.Println("CONSOLE: The audit trail is not enabled")
+				continue
+			}
+
+			var minSeverity uint8 = AUDIT_INFO
+			if len(slicedResp) == 2 {
+				found := false
+				for severity, name := range AUDIT_SEVERITY_NAMES {
+					if name == slicedResp[1] {
+						minSeverity, found = uint8(severity), true
+					}
+				}
+				if !found {
+					fmt.Printf("CONSOLE, Error: Unknown severity \"%s\", expected info, warning or critical\n", slicedResp[1])
+					continue
+				}
+			}
+
+			cfg.Audit.printRecent(minSeverity)
 		} else {
 			fmt.Printf("CONSOLE: Command %s unknown\n", command)
 		}
 	}
 
 }
+
+// Parses the expiry of a delegation, given either as a duration from now or as an RFC 3339 time
+func parseExpiry(expiry string) (time.Time, error) {
+	duration, err := time.ParseDuration(expiry)
+	if err == nil {
+		return time.Now().Add(duration), nil
+	}
+	return time.Parse(time.RFC3339, expiry)
+}
@@ -22,12 +22,18 @@ const (
 
 	MAX_PAYLOAD_LEN = 256
 
-	DEVICE_ID_LEN   = 4
-	REB_CNT_LEN     = 4
-	REQ_CNT_LEN     = 4
-	ACCESS_TYPE_LEN = 2
-	CHALLENGE_LEN   = 16
-	RANDOM_LEN      = 16
+	DEVICE_ID_LEN     = 4
+	REB_CNT_LEN       = 4
+	REQ_CNT_LEN       = 4
+	ACCESS_TYPE_LEN   = 2
+	CHALLENGE_LEN     = 16
+	RANDOM_LEN        = 16
+	DECISION_LEN      = 1
+	REASON_LEN        = 1
+	OWNER_KIND_LEN    = 1
+	TICKET_LEN        = 4
+	DELEGATION_OP_LEN = 1
+	EXPIRES_LEN       = 8
 )
 
 // Header constants
@@ -44,18 +50,33 @@ const (
 	PAYLOAD_AUTH_REQ
 	PAYLOAD_AUTH_RESP
 	PAYLOAD_CONTROL
+	PAYLOAD_OWNER_ALERT
+	PAYLOAD_OWNER_DECISION
+	PAYLOAD_SIGNUP_REJECT
+	PAYLOAD_DELEGATION
 )
 
 // Payload lengths. NOTE: They are DIFFERENT to the ones between gateway and server
 const (
-	LEN_PAYLOAD_SIGNUP_REQ  = 2 + KEY_LEN + KEY_LEN + HMAC_OUTPUT_SIZE                                       // LOWER BOUND, 2 bytes device type
-	LEN_PAYLOAD_SIGNUP_RESP = 4 + KEY_LEN + HMAC_OUTPUT_SIZE                                                 // NOTE: This is only for SENDing!
-	LEN_PAYLOAD_AUTH_REQ    = DEVICE_ID_LEN + REB_CNT_LEN + REQ_CNT_LEN + ACCESS_TYPE_LEN + HMAC_OUTPUT_SIZE // Authentication request payload is: |  dev_id  |  req_cnt  |  req_cnt  |  access_type  |  hmac_tag  |
-	LEN_PAYLOAD_AUTH_RESP   = RANDOM_LEN + HMAC_OUTPUT_SIZE
-	LEN_PAYLOAD_CONTROL     = 3 // FIXME: Set correct LEN_CONTROL
+	LEN_PAYLOAD_SIGNUP_REQ     = 2 + KEY_LEN + KEY_LEN + HMAC_OUTPUT_SIZE                                                                                                         // LOWER BOUND, 2 bytes device type
+	LEN_PAYLOAD_SIGNUP_RESP    = 4 + KEY_LEN + HMAC_OUTPUT_SIZE                                                                                                                   // NOTE: This is only for SENDing!
+	LEN_PAYLOAD_AUTH_REQ       = DEVICE_ID_LEN + REB_CNT_LEN + REQ_CNT_LEN + ACCESS_TYPE_LEN + HMAC_OUTPUT_SIZE                                                                   // Authentication request payload is: |  dev_id  |  req_cnt  |  req_cnt  |  access_type  |  hmac_tag  |
+	LEN_PAYLOAD_AUTH_RESP      = DECISION_LEN + REASON_LEN + RANDOM_LEN + HMAC_OUTPUT_SIZE                                                                                        // Authentication response payload is: |  decision  |  reason  |  sRandom  |  hmac_tag  |
+	LEN_PAYLOAD_CONTROL        = 3                                                                                                                                                // FIXME: Set correct LEN_CONTROL
+	LEN_PAYLOAD_OWNER_ALERT    = OWNER_KIND_LEN + TICKET_LEN + DEVICE_ID_LEN + ACCESS_TYPE_LEN + HMAC_OUTPUT_SIZE                                                                 // Owner alert payload is: |  kind  |  ticket  |  dev_id  |  detail  |  hmac_tag  |
+	LEN_PAYLOAD_OWNER_DECISION = DEVICE_ID_LEN + REB_CNT_LEN + REQ_CNT_LEN + OWNER_KIND_LEN + TICKET_LEN + DECISION_LEN + HMAC_OUTPUT_SIZE                                        // Owner decision payload is: |  dev_id  |  reb_cnt  |  req_cnt  |  kind  |  ticket  |  decision  |  hmac_tag  |
+	LEN_PAYLOAD_SIGNUP_REJECT  = REASON_LEN                                                                                                                                       // Signup rejection payload is: |  reason  |. NOTE: Unauthenticated, the gateway holds no session key yet
+	LEN_PAYLOAD_DELEGATION     = DEVICE_ID_LEN + REB_CNT_LEN + REQ_CNT_LEN + DELEGATION_OP_LEN + DEVICE_ID_LEN + DEVICE_ID_LEN + ACCESS_TYPE_LEN + EXPIRES_LEN + HMAC_OUTPUT_SIZE // Delegation payload is: |  dev_id  |  reb_cnt  |  req_cnt  |  op  |  grantee  |  grantor  |  access_type  |  expires  |  hmac_tag  |
 )
 
-var PAYLOAD_LENS []uint16 = []uint16{LEN_PAYLOAD_SIGNUP_REQ, LEN_PAYLOAD_SIGNUP_RESP, LEN_PAYLOAD_AUTH_REQ, LEN_PAYLOAD_AUTH_RESP, LEN_PAYLOAD_CONTROL}
+var PAYLOAD_LENS []uint16 = []uint16{LEN_PAYLOAD_SIGNUP_REQ, LEN_PAYLOAD_SIGNUP_RESP, LEN_PAYLOAD_AUTH_REQ, LEN_PAYLOAD_AUTH_RESP, LEN_PAYLOAD_CONTROL, LEN_PAYLOAD_OWNER_ALERT, LEN_PAYLOAD_OWNER_DECISION, LEN_PAYLOAD_SIGNUP_REJECT, LEN_PAYLOAD_DELEGATION}
+
+// Kinds of owner alerts and the owner decisions answering them
+const (
+	OWNER_KIND_SIGNUP  = iota // A device signed up and awaits approval. Ticket and dev_id are the new device's ID, detail is its device type
+	OWNER_KIND_ACCESS         // A write request is parked. Ticket identifies the parked request, dev_id is the requesting device, detail is the access type
+	OWNER_KIND_ANOMALY        // A device deviates from its baseline. Informational, not to be decided on. Ticket identifies the anomaly, dev_id is the device, detail is the kind of anomaly
+)
 
 // Access types
 const (
@@ -66,6 +87,57 @@ const (
 	DUMMY_REQUEST      = 0x69
 )
 
+// Names of the access types, as used in the policy file. Extended by the access types of the device-type registry
+var ACCESS_TYPE_NAMES map[string]uint16 = map[string]uint16{
+	"SAMPLE_SENSOR_0":    SAMPLE_SENSOR_0,
+	"SAMPLE_SENSOR_1":    SAMPLE_SENSOR_1,
+	"CONTROL_ACTUATOR_0": CONTROL_ACTUATOR_0,
+	"CONTROL_ACTUATOR_1": CONTROL_ACTUATOR_1,
+}
+
+// Reason codes carried in the signup rejection
+const (
+	SIGNUP_ACCEPTED                = iota // Not sent, signals that the signup passed the check
+	SIGNUP_REJECT_UNKNOWN_TYPE            // The device type is not in the device-type registry
+	SIGNUP_REJECT_CAP_URI_TOO_LONG        // The capability URI exceeds the maximum length of the device type
+	SIGNUP_REJECT_BUSY                    // Too many signups await their handshake, the gateway may retry later
+	SIGNUP_REJECT_IDS_EXHAUSTED           // Every device ID is in use or quarantined
+	SIGNUP_REJECT_TYPE_MISMATCH           // The static public key belongs to a device of another device type
+	SIGNUP_REJECT_NOT_PROVISIONED         // No scan of the static public key arrived while the signup was held
+	SIGNUP_REJECT_SERVER_ERROR            // The handshake failed or the device could not be stored, the gateway may retry later
+)
+
+// Decisions carried in the authentication response
+const (
+	DECISION_DENY  = 0
+	DECISION_ALLOW = 1
+)
+
+// Reason codes carried in the authentication response
+const (
+	REASON_NONE                  = iota // Nothing to report, e.g. no policy configured
+	REASON_POLICY_RULE                  // Decided by an explicit rule of the policy
+	REASON_POLICY_DEFAULT               // No rule matched ==> Decided by the default of the policy
+	REASON_CAPABILITY_MISSING           // The device's capability document has not (yet) been fetched
+	REASON_CAPABILITY_UNDECLARED        // The access type is not declared in the device's capability document
+	REASON_CAPABILITY_UNVERIFIED        // The device's capability document failed signature verification ==> Restricted to the fallback access types
+	REASON_PENDING_APPROVAL             // The device has not (yet) been approved by the home owner device
+	REASON_OWNER_DECISION               // Decided by the home owner device
+	REASON_OWNER_TIMEOUT                // The home owner device did not decide in time ==> Decided by the default
+	REASON_OWNER_UNAVAILABLE            // No home owner device exists to decide ==> Decided by the default
+	REASON_RATE_LIMITED                 // The device sent more requests than its token bucket allows
+	REASON_QUOTA_EXCEEDED               // The device used up its daily quota
+	REASON_SCHEDULE_WINDOW              // The access type is not permitted at this time of day, weekday or date
+	REASON_SCHEDULE_INTERVAL            // The previous grant of the access type is more recent than the schedule permits
+	REASON_INTERLOCK                    // A recently granted request of another device engaged a safety interlock
+	REASON_LEASE_HELD                   // Another device holds the lease on the actuator
+	REASON_LEASE_QUEUED                 // Granted after waiting for the lease on the actuator
+	REASON_TYPE_UNSUPPORTED             // The access type is not in the catalogue of the device type
+	REASON_TYPE_DEFAULT                 // No rule matched ==> Decided by the default policy of the device type
+	REASON_DELEGATED                    // Granted by a delegation of another device's access type
+	REASON_SUSPENDED                    // The device is suspended by the admin
+)
+
 // ---------------------------------------------------------------------------------
 //                                  Typedefs
 // ---------------------------------------------------------------------------------
@@ -77,6 +149,7 @@ type Header struct {
 
 type SignupReq struct {
 	Conn    *net.TCPConn
+	ConnId  uint32 // ID of the connection handler the signup arrived on
 	DevType uint16
 	SPubGW  [KEY_LEN]byte
 	EPubGw  [KEY_LEN]byte
@@ -90,12 +163,43 @@ type AuthReq struct {
 	RebCnt     uint32
 	ReqCnt     uint32
 	MacTag     []byte
+	Conn       *net.TCPConn `json:"-"` // Connection the request arrived on, which the response is sent on
+	ConnId     uint32       `json:"-"` // ID of the connection handler the request arrived on
 	// rawChal    []byte
 }
 
+// Decision of the home owner device on an owner alert
+type OwnerDecision struct {
+	DevId    uint32 // ID of the device sending the decision, which must be the home owner device
+	RebCnt   uint32
+	ReqCnt   uint32
+	Kind     uint8
+	Ticket   uint32
+	Decision uint8
+	MacTag   []byte
+	Source   AuditSource `json:"-"` // Connection the decision arrived on
+}
+
+// Delegation issued or revoked by the home owner device, see delegation.go
+type DelegationReq struct {
+	DevId      uint32 // ID of the device sending the request, which must be the home owner device
+	RebCnt     uint32
+	ReqCnt     uint32
+	Op         uint8
+	Grantee    uint32
+	Grantor    uint32
+	AccessType uint16
+	Expires    uint64 // Unix time in seconds
+	MacTag     []byte
+	Source     AuditSource `json:"-"` // Connection the request arrived on, zero if issued on the console
+}
+
 type Scan struct {
-	SPubGW [KEY_LEN]byte
-	Psk    [KEY_LEN]byte
+	SPubGW  [KEY_LEN]byte
+	Psk     [KEY_LEN]byte
+	Created time.Time
+	TTL     time.Duration // Time after its creation the scan expires unless consumed by a signup, 0 ==> never expires
+	Label   string        // Set by the operator, e.g. where the device is installed
 }
 
 type Sessionkeys struct {
@@ -103,14 +207,40 @@ type Sessionkeys struct {
 	K_s_gw []byte // Session key server -> gateway
 }
 
+// Outcomes of an authentication request, as recorded in its log entry
+const (
+	LOG_OUTCOME_PENDING       = iota // Not answered yet, e.g. parked or waiting for a lease
+	LOG_OUTCOME_GRANTED              // Answered with a grant
+	LOG_OUTCOME_DENIED               // Answered with a denial
+	LOG_OUTCOME_BAD_MAC              // Dropped, the MAC tag is not authentic
+	LOG_OUTCOME_STALE_COUNTER        // Dropped, the counters are older than the device's
+	LOG_OUTCOME_DROPPED              // Dropped, another request of the device is waiting
+	LOG_OUTCOME_PAIRED               // Authentic pairing dummy message, never answered
+	LOG_OUTCOME_UNANSWERED           // Decided, but the response could not be created, persisted or the device was removed
+	LOG_OUTCOME_REVOKED              // Dropped unverified, the device is revoked
+)
+
+var LOG_OUTCOME_NAMES []string = []string{"pending", "granted", "denied", "bad MAC", "stale counter", "dropped", "paired", "unanswered", "revoked"}
+
 type LogEntry struct {
-	ArrivalTime time.Time
-	DevId       uint32
-	Paired      bool
-	AuthReq     AuthReq
+	Seq            uint64 // Position in the device's log
+	ArrivalTime    time.Time
+	DevId          uint32
+	Paired         bool
+	Granted        bool // Set once the request has been answered with a grant
+	Outcome        uint8
+	Reason         uint8         // Reason code sent with the decision, REASON_NONE if the request was not answered
+	RemoteAddr     string        // Address of the gateway's connection
+	ConnId         uint32        // ID of the connection handler the request arrived on
+	Latency        time.Duration // Time from arrival until the outcome
+	RandomnessHash []byte        // SHA-256 of the randomness sent in the response, nil if none was sent
+	PrevHash       []byte        // Hash of the previous entry, nil for the first one, see logchain.go
+	Hash           []byte        // Set once the entry is sealed into the hash chain, it does not change afterwards
+	AuthReq        AuthReq
+	Delegation     *Delegation // Delegation the request used, nil if none. Granted uses are recorded in the logs of both grantee and grantor
 }
 
-type RepairingState struct { // Used to allow re-pairing during normal operation
+type RepairingState struct { // Used to allow re-pairing during normal operation, see scan.go
 	scan     Scan
 	sessKeys Sessionkeys
 }
@@ -125,14 +255,64 @@ type DeviceState struct {
 	LastRandomness []byte
 	Sesskeys       Sessionkeys
 	Paired         bool
+	Owner          bool // Set for the home owner device
+	Pending        bool // Set until the device is approved by the home owner device
+	Status         uint8
 	ScanData       Scan
-	Log            []LogEntry
+	Repairing      *RepairingState // Keys of a repeated signup, replacing Sesskeys once the gateway proves them. Not persisted
+	Log            *DeviceLog
 }
 
-type ServerState map[uint32]DeviceState
+// Lifecycle states of a device, see lifecycle.go
+const (
+	DEVICE_ACTIVE    = iota
+	DEVICE_SUSPENDED // Authentication requests are denied, the keys are kept
+	DEVICE_REVOKED   // Keys destroyed, authentication requests are dropped before any MAC computation
+)
+
+var DEVICE_STATUS_NAMES []string = []string{"active", "suspended", "revoked"}
 
 type Scans map[[32]byte]Scan
 
+// Configuration of the server, assembled in main from the command line flags
+type Config struct {
+	DeviceTypes *DeviceTypeRegistry // Known device types, nil ==> every device type is accepted
+
+	Policy       *PolicyEngine    // Access-control policy, nil ==> every authentic request is granted
+	Capabilities *CapabilityCache // Capability documents, nil ==> capability documents are not enforced
+
+	ActuatorApproval bool          // Park granted write (e.g. actuator) requests until the home owner device decides on them
+	ApprovalTimeout  time.Duration // Time the home owner device has to decide on a parked request
+	ApprovalDefault  uint8         // Decision applied on timeout or if no home owner device exists
+
+	RateLimiter *RateLimiter  // Token buckets and daily quotas, nil ==> requests are not rate limited
+	Leases      *LeaseManager // Exclusive leases on actuators, nil ==> no leases are required
+
+	Delegations *DelegationStore // Guest grants issued by the home owner device or on the console
+
+	Anomalies *AnomalyDetector // Per-device baselines of the requests, nil ==> anomalies are not detected
+
+	Store *Store // Journal and snapshots of the device registry, nil ==> devices are forgotten on restart
+
+	AuthShards int // Number of goroutines checking authentication requests in parallel, each owning the devices whose ID modulo AuthShards is its index
+
+	HandshakeWorkers int // Number of goroutines performing the handshakes of signups
+	HandshakeQueue   int // Number of signups which may await a handshake worker, further signups are rejected
+
+	ScanTTL time.Duration // TTL of scans entered on the console without one, 0 ==> they never expire
+
+	HeldSignups *SignupHold // Signups waiting for the scan of their key, nil ==> signups without scan are rejected right away
+
+	LogBuffer  int         // Number of log entries kept in memory per device
+	LogArchive *LogArchive // Segment files older log entries are spilled to, nil ==> older entries are dropped
+	LogKey     []byte      // MACs the checkpoints of the logs, see logchain.go
+
+	Audit *Auditor // Trail of security events, nil ==> events are not recorded
+
+	RandomDevIds bool          // Hand out random 32-bit device IDs instead of sequential ones, such that the IDs do not reveal the number of devices
+	IdQuarantine time.Duration // Time after which the ID of a deleted device may be handed out again
+}
+
 // ---------------------------------------------------------------------------------
 //                                  Errors
 // ---------------------------------------------------------------------------------
@@ -163,14 +343,25 @@ func (e *InvalidPayloadLen) Error() string {
 	return fmt.Sprintf("HandlerId = %d: Header with payload type: %d, expected payload length: %d but actual payload length: %d", e.HandlerId, payloadType, expectedLen, actualLen)
 }
 
-// Invalid access type error
-type InvalidAccessType struct {
-	HandlerId  uint32
-	AccessType uint16
+// Invalid owner decision error
+type InvalidOwnerDecision struct {
+	HandlerId uint32
+	Kind      uint8
+	Decision  uint8
+}
+
+func (e *InvalidOwnerDecision) Error() string {
+	return fmt.Sprintf("HandlerId = %d: Owner decision with kind: %d and decision: %d", e.HandlerId, e.Kind, e.Decision)
 }
 
-func (e *InvalidAccessType) Error() string {
-	return fmt.Sprintf("HandlerId = %d: Payload with access type: %d", e.HandlerId, e.AccessType)
+// Invalid delegation request error
+type InvalidDelegationOp struct {
+	HandlerId uint32
+	Op        uint8
+}
+
+func (e *InvalidDelegationOp) Error() string {
+	return fmt.Sprintf("HandlerId = %d: Delegation request with op: %d", e.HandlerId, e.Op)
 }
 
 // Not yet implemented payload type
@@ -182,3 +373,103 @@ type NotYetImplementedPayloadType struct {
 func (e *NotYetImplementedPayloadType) Error() string {
 	return fmt.Sprintf("HandlerId = %d: Payload with not yet payload type: %d", e.HandlerId, e.PayloadType)
 }
+
+// Invalid policy file error
+type InvalidPolicy struct {
+	Path   string
+	Reason string
+}
+
+func (e *InvalidPolicy) Error() string {
+	return fmt.Sprintf("Policy file %s is invalid: %s", e.Path, e.Reason)
+}
+
+// Invalid capability URI error
+type InvalidCapURI struct {
+	URI    string
+	Reason string
+}
+
+func (e *InvalidCapURI) Error() string {
+	return fmt.Sprintf("Capability URI %s is invalid: %s", e.URI, e.Reason)
+}
+
+// Invalid capability document error
+type InvalidCapabilityDoc struct {
+	URI    string
+	Reason string
+}
+
+func (e *InvalidCapabilityDoc) Error() string {
+	return fmt.Sprintf("Capability document at %s is invalid: %s", e.URI, e.Reason)
+}
+
+// Invalid key file error
+type InvalidKeyFile struct {
+	Path   string
+	Reason string
+}
+
+func (e *InvalidKeyFile) Error() string {
+	return fmt.Sprintf("Key file %s is invalid: %s", e.Path, e.Reason)
+}
+
+// Capability document failed signature verification error
+type UnverifiedCapabilityDoc struct {
+	URI     string
+	DevType uint16
+	Reason  string
+}
+
+func (e *UnverifiedCapabilityDoc) Error() string {
+	return fmt.Sprintf("Capability document at %s for device type %d failed verification: %s", e.URI, e.DevType, e.Reason)
+}
+
+// Unknown access type name error
+type UnknownAccessTypeName struct {
+	Name string
+}
+
+func (e *UnknownAccessTypeName) Error() string {
+	return fmt.Sprintf("Unknown access type name: \"%s\"", e.Name)
+}
+
+// Invalid rate limit file error
+type InvalidRateLimits struct {
+	Path   string
+	Reason string
+}
+
+func (e *InvalidRateLimits) Error() string {
+	return fmt.Sprintf("Rate limit file %s is invalid: %s", e.Path, e.Reason)
+}
+
+// Invalid anomaly detection configuration error
+type InvalidAnomalyConfig struct {
+	Path   string
+	Reason string
+}
+
+func (e *InvalidAnomalyConfig) Error() string {
+	return fmt.Sprintf("Anomaly detection configuration %s is invalid: %s", e.Path, e.Reason)
+}
+
+// Invalid store file error
+type InvalidStore struct {
+	Path   string
+	Reason string
+}
+
+func (e *InvalidStore) Error() string {
+	return fmt.Sprintf("Store file %s is invalid: %s", e.Path, e.Reason)
+}
+
+// Invalid device-type registry error
+type InvalidDeviceTypes struct {
+	Path   string
+	Reason string
+}
+
+func (e *InvalidDeviceTypes) Error() string {
+	return fmt.Sprintf("Device-type registry %s is invalid: %s", e.Path, e.Reason)
+}
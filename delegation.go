@@ -0,0 +1,239 @@
+// Delegated, time-limited guest grants, e.g. "device 7 may use CONTROL_ACTUATOR_0 of the door controller until Sunday"
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Operations of a delegation request
+const (
+	DELEGATION_OP_ISSUE  = iota // Grant the access type until the expiry, replacing an existing delegation of the same grantee, grantor and access type
+	DELEGATION_OP_REVOKE        // Revoke the delegation of the grantee, grantor and access type. The expiry is ignored
+)
+
+// A delegation lets the grantee use an access type of the grantor's catalogue. It replaces the device type, capability and policy checks of the
+// grantee's requests of the access type, schedules, interlocks, rate limits, approval and leases still apply
+type Delegation struct {
+	Id         uint32
+	Grantee    uint32 // Device using the access type, e.g. a guest's phone gateway
+	Grantor    uint32 // Device whose access type is used, e.g. the door controller
+	AccessType uint16
+	Expires    time.Time
+	IssuedBy   string // Either the console or the home owner device, for console output
+}
+
+type DelegationStore struct {
+	mu          sync.Mutex
+	delegations map[uint32]*Delegation
+	nextId      uint32
+}
+
+func newDelegationStore() *DelegationStore {
+	return &DelegationStore{delegations: make(map[uint32]*Delegation)}
+}
+
+// Fills the delegations with those of the store. Expired ones are dropped
+func (s *DelegationStore) restore(store *Store) {
+	delegations, nextId := store.storedDelegations()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range delegations {
+		s.delegations[delegations[i].Id] = &delegations[i]
+	}
+	s.nextId = nextId
+	s.prune(store, time.Now())
+
+	if store != nil {
+		fmt.Println("INFO, delegation: Restored", len(s.delegations), "delegations")
+	}
+}
+
+// Removes the expired delegations. The caller must hold the lock
+func (s *DelegationStore) prune(store *Store, now time.Time) {
+	for id, delegation := range s.delegations {
+		if !now.Before(delegation.Expires) && store.deleteDelegation(id) {
+			fmt.Println("INFO, delegation: Delegation", id, "of access type", delegation.AccessType, "from device", delegation.Grantor, "to device", delegation.Grantee, "expired")
+			delete(s.delegations, id)
+		}
+	}
+}
+
+// Stores the delegation and returns its ID. Returns false if the grantee already uses the access type of another grantor, or if the
+// delegation could not be made durable, in which case it is not issued
+func (s *DelegationStore) issue(store *Store, grantee uint32, grantor uint32, accessType uint16, expires time.Time, issuedBy string) (uint32, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(store, time.Now())
+
+	// A request names the access type only, not the grantor ==> At most one grantor per grantee and access type
+	for _, other := range s.delegations {
+		if other.Grantee == grantee && other.AccessType == accessType && other.Grantor != grantor {
+			fmt.Println("WARNING, delegation: Device", grantee, "already uses access type", accessType, "of device", other.Grantor, "by delegation", other.Id,
+				"==> Delegation from device", grantor, "ignored, revoke the other one first")
+			return 0, false
+		}
+	}
+
+	delegation := Delegation{Id: s.nextId, Grantee: grantee, Grantor: grantor, AccessType: accessType, Expires: expires, IssuedBy: issuedBy}
+	if !store.putDelegation(delegation) {
+		return 0, false
+	}
+	s.nextId += 1
+	s.remove(store, grantee, grantor, accessType)
+	s.delegations[delegation.Id] = &delegation
+	return delegation.Id, true
+}
+
+// Removes the delegation with the ID. The caller must hold the lock.
+// NOTE: A revocation takes effect even if it could not be made durable, the delegation then returns after a restart
+func (s *DelegationStore) removeId(store *Store, id uint32) {
+	store.deleteDelegation(id)
+	delete(s.delegations, id)
+}
+
+// Removes the delegation of the grantee, grantor and access type. The caller must hold the lock. Returns true if one existed
+func (s *DelegationStore) remove(store *Store, grantee uint32, grantor uint32, accessType uint16) bool {
+	for id, delegation := range s.delegations {
+		if delegation.Grantee == grantee && delegation.Grantor == grantor && delegation.AccessType == accessType {
+			s.removeId(store, id)
+			return true
+		}
+	}
+	return false
+}
+
+// Revokes the delegation of the grantee, grantor and access type. Returns true if one existed
+func (s *DelegationStore) revokeMatching(store *Store, grantee uint32, grantor uint32, accessType uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.remove(store, grantee, grantor, accessType)
+}
+
+// Revokes the delegation with the ID. Returns true if it existed
+func (s *DelegationStore) revoke(store *Store, id uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists := s.delegations[id]
+	if exists {
+		s.removeId(store, id)
+	}
+	return exists
+}
+
+// Revokes every delegation the device is grantee or grantor of. A nil store holds no delegations
+func (s *DelegationStore) forget(store *Store, devId uint32) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, delegation := range s.delegations {
+		if delegation.Grantee == devId || delegation.Grantor == devId {
+			s.removeId(store, id)
+		}
+	}
+}
+
+// Returns a copy of the delegation letting the grantee use the access type at the given time, if any. A nil store holds no delegations
+func (s *DelegationStore) active(grantee uint32, accessType uint16, now time.Time) (*Delegation, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// NOTE: issue allows one grantor per grantee and access type, the lowest ID only decides if the store held several before
+	var found *Delegation
+	for _, delegation := range s.delegations {
+		if delegation.Grantee == grantee && delegation.AccessType == accessType && now.Before(delegation.Expires) && (found == nil || delegation.Id < found.Id) {
+			found = delegation
+		}
+	}
+	if found == nil {
+		return nil, false
+	}
+	delegation := *found
+	return &delegation, true
+}
+
+// Prints the delegations the device is grantee or grantor of to the console
+func (s *DelegationStore) printFor(store *Store, devId uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(store, time.Now())
+
+	ids := make([]int, 0, len(s.delegations))
+	for id, delegation := range s.delegations {
+		if delegation.Grantee == devId || delegation.Grantor == devId {
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids)
+
+	fmt.Printf("CONSOLE: - - - - - Delegations of device ID: %v - - - - -\n", devId)
+	for _, id := range ids {
+		delegation := s.delegations[uint32(id)]
+		fmt.Printf("Delegation: %v, Grantee: %v, Grantor: %v, Access Type: %v, Expires: %v, Issued by: %v\n", delegation.Id, delegation.Grantee, delegation.Grantor, delegation.AccessType, delegation.Expires.Format(time.RFC3339), delegation.IssuedBy)
+	}
+}
+
+// Checks and applies a delegation request of the home owner device or the console
+func applyDelegation(cfg *Config, devices *DeviceRegistry, req DelegationReq, issuedBy string) {
+
+	// (1) Revocations need no checks, revoking a delegation that does not exist is harmless
+	if req.Op == DELEGATION_OP_REVOKE {
+		if cfg.Delegations.revokeMatching(cfg.Store, req.Grantee, req.Grantor, req.AccessType) {
+			fmt.Println("INFO, delegation: Revoked delegation of access type", req.AccessType, "from device", req.Grantor, "to device", req.Grantee)
+		}
+		return
+	}
+
+	// (2) Both devices must exist and differ, and the access type must be in the grantor's catalogue
+	granteeState, granteeExists := devices.get(req.Grantee)
+	grantorState, grantorExists := devices.get(req.Grantor)
+	if !granteeExists || !grantorExists || req.Grantee == req.Grantor {
+		fmt.Println("WARNING, delegation: Delegation from device", req.Grantor, "to device", req.Grantee, "refers to unknown devices ==> Ignored")
+		return
+	}
+	if granteeState.Pending {
+		fmt.Println("WARNING, delegation: Device", req.Grantee, "awaits approval ==> Delegation ignored")
+		return
+	}
+	if _, exists := cfg.DeviceTypes.accessType(grantorState.Type, req.AccessType); !exists {
+		fmt.Println("WARNING, delegation: Access type", req.AccessType, "is not in the catalogue of device", req.Grantor, "of type", cfg.DeviceTypes.name(grantorState.Type), "==> Delegation ignored")
+		return
+	}
+
+	// (3) Expiry must lie in the future
+	expires := time.Unix(int64(req.Expires), 0)
+	if !time.Now().Before(expires) {
+		fmt.Println("WARNING, delegation: Delegation from device", req.Grantor, "to device", req.Grantee, "expired already ==> Ignored")
+		return
+	}
+
+	id, issued := cfg.Delegations.issue(cfg.Store, req.Grantee, req.Grantor, req.AccessType, expires, issuedBy)
+	if !issued {
+		return
+	}
+	fmt.Println("INFO, delegation: Device", req.Grantee, "may use access type", cfg.DeviceTypes.accessTypeName(grantorState.Type, req.AccessType), "of device", req.Grantor, "until", expires.Format(time.RFC3339), "as delegation", id)
+}
+
+// Records the granted use of a delegation in the grantor's log, next to the entry in the grantee's log
+func recordDelegatedUse(devices *DeviceRegistry, entry LogEntry) {
+	entry.DevId = entry.AuthReq.DevId
+	if grantorState, exists := devices.get(entry.Delegation.Grantor); exists {
+		grantorState.Log.append(entry)
+	}
+}
@@ -0,0 +1,222 @@
+// Registry of the device types the deployment knows, loaded from configuration
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+)
+
+// Cipher suites of the signup handshake. The server implements exactly one
+const (
+	CIPHER_SUITE_X25519_HKDF_SHA256 = "X25519-HKDF-SHA256-HMAC-SHA256" // X25519 static-ephemeral handshake, HKDF-SHA256 key derivation, HMAC-SHA256 authentication
+)
+
+// Categories of access types
+const (
+	CATEGORY_READ  = "read"  // Reads state, e.g. samples a sensor
+	CATEGORY_WRITE = "write" // Changes the physical world, e.g. drives an actuator. Subject to the home owner device's approval, if enabled
+	CATEGORY_ADMIN = "admin" // Changes the configuration of the device
+)
+
+// Risk levels of access types
+var RISK_LEVELS map[string]uint8 = map[string]uint8{
+	"low":      0,
+	"medium":   1,
+	"high":     2,
+	"critical": 3,
+}
+
+// Entry of a device type's access-type catalogue:
+//
+//	{ "code": 7, "name": "UNLOCK_DOOR", "category": "write", "risk": "critical" }
+type AccessTypeDef struct {
+	Code     uint16 `json:"code"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	Risk     string `json:"risk"`
+}
+
+// Catalogue of the device types without a registry entry
+var BUILTIN_ACCESS_TYPES []AccessTypeDef = []AccessTypeDef{
+	{Code: SAMPLE_SENSOR_0, Name: "SAMPLE_SENSOR_0", Category: CATEGORY_READ, Risk: "low"},
+	{Code: SAMPLE_SENSOR_1, Name: "SAMPLE_SENSOR_1", Category: CATEGORY_READ, Risk: "low"},
+	{Code: CONTROL_ACTUATOR_0, Name: "CONTROL_ACTUATOR_0", Category: CATEGORY_WRITE, Risk: "high"},
+	{Code: CONTROL_ACTUATOR_1, Name: "CONTROL_ACTUATOR_1", Category: CATEGORY_WRITE, Risk: "high"},
+}
+
+// Entry of the registry:
+//
+//	{ "code": 1, "name": "window-controller",
+//	  "accessTypes": [ { "code": 0, "name": "SAMPLE_SENSOR_0", "category": "read", "risk": "low" },
+//	                   { "code": 7, "name": "OPEN_WINDOW", "category": "write", "risk": "high" } ],
+//	  "defaultPolicy": "deny", "cipherSuite": "X25519-HKDF-SHA256-HMAC-SHA256", "maxCapURILen": 128 }
+//
+// defaultPolicy decides requests of the type which no rule of the policy matches, overriding the policy's default. It may be omitted.
+// Access type names are global, i.e. policies, capability documents and rate limits refer to them by name, so a name must have the same code in every type
+type DeviceType struct {
+	Code          uint16          `json:"code"`
+	Name          string          `json:"name"`
+	AccessTypes   []AccessTypeDef `json:"accessTypes"`
+	DefaultPolicy string          `json:"defaultPolicy"`
+	CipherSuite   string          `json:"cipherSuite"`
+	MaxCapURILen  int             `json:"maxCapURILen"` // 0 ==> No limit besides the payload length
+
+	accessTypes     map[uint16]*AccessTypeDef
+	hasDefault      bool
+	defaultDecision uint8
+}
+
+type DeviceTypeRegistry struct {
+	types map[uint16]*DeviceType
+}
+
+// Registry file layout:
+//
+//	{ "types": [ { "code": 1, ... }, ... ] }
+func loadDeviceTypes(path string) (*DeviceTypeRegistry, error) {
+
+	// (1) Read and parse the registry file
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Types []*DeviceType `json:"types"`
+	}
+	err = json.Unmarshal(raw, &file)
+	if err != nil {
+		return nil, &InvalidDeviceTypes{Path: path, Reason: err.Error()}
+	}
+
+	// (2) Check and resolve every entry
+	registry := &DeviceTypeRegistry{types: make(map[uint16]*DeviceType)}
+	for _, devType := range file.Types {
+		if _, exists := registry.types[devType.Code]; exists {
+			return nil, &InvalidDeviceTypes{Path: path, Reason: "duplicate code " + strconv.Itoa(int(devType.Code))}
+		}
+
+		if devType.CipherSuite != CIPHER_SUITE_X25519_HKDF_SHA256 {
+			return nil, &InvalidDeviceTypes{Path: path, Reason: "unsupported cipher suite \"" + devType.CipherSuite + "\" for type " + devType.Name}
+		}
+
+		devType.accessTypes = make(map[uint16]*AccessTypeDef)
+		for i := range devType.AccessTypes {
+			def := &devType.AccessTypes[i]
+			err = resolveAccessTypeDef(path, devType, def)
+			if err != nil {
+				return nil, err
+			}
+			devType.accessTypes[def.Code] = def
+		}
+
+		if devType.DefaultPolicy != "" {
+			allow, err := parseDecision(path, devType.DefaultPolicy)
+			if err != nil {
+				return nil, err
+			}
+			devType.hasDefault = true
+			devType.defaultDecision = DECISION_DENY
+			if allow {
+				devType.defaultDecision = DECISION_ALLOW
+			}
+		}
+
+		registry.types[devType.Code] = devType
+	}
+
+	return registry, nil
+}
+
+// Checks an entry of a type's catalogue and registers its name globally
+func resolveAccessTypeDef(path string, devType *DeviceType, def *AccessTypeDef) error {
+	if def.Code == DUMMY_REQUEST {
+		return &InvalidDeviceTypes{Path: path, Reason: "code " + strconv.Itoa(DUMMY_REQUEST) + " is reserved for pairing, in type " + devType.Name}
+	}
+	if _, exists := devType.accessTypes[def.Code]; exists {
+		return &InvalidDeviceTypes{Path: path, Reason: "duplicate access type code " + strconv.Itoa(int(def.Code)) + " in type " + devType.Name}
+	}
+
+	switch def.Category {
+	case CATEGORY_READ, CATEGORY_WRITE, CATEGORY_ADMIN:
+	default:
+		return &InvalidDeviceTypes{Path: path, Reason: "unknown category \"" + def.Category + "\" of access type " + def.Name}
+	}
+
+	if _, exists := RISK_LEVELS[def.Risk]; !exists {
+		return &InvalidDeviceTypes{Path: path, Reason: "unknown risk level \"" + def.Risk + "\" of access type " + def.Name}
+	}
+
+	code, exists := ACCESS_TYPE_NAMES[def.Name]
+	if exists && code != def.Code {
+		return &InvalidDeviceTypes{Path: path, Reason: "access type " + def.Name + " has code " + strconv.Itoa(int(def.Code)) + " in type " + devType.Name + " but code " + strconv.Itoa(int(code)) + " elsewhere"}
+	}
+	ACCESS_TYPE_NAMES[def.Name] = def.Code
+
+	return nil
+}
+
+// Returns the catalogue entry of the access type for a device of the given type, or false if the type does not define the access type
+func (r *DeviceTypeRegistry) accessType(code uint16, accessType uint16) (*AccessTypeDef, bool) {
+	devType, _ := r.lookup(code)
+	if devType != nil {
+		def, exists := devType.accessTypes[accessType]
+		return def, exists
+	}
+
+	for i := range BUILTIN_ACCESS_TYPES {
+		if BUILTIN_ACCESS_TYPES[i].Code == accessType {
+			return &BUILTIN_ACCESS_TYPES[i], true
+		}
+	}
+	return nil, false
+}
+
+// Returns the name, category and risk level of the access type for console and log output, falling back to the code for unknown access types
+func (r *DeviceTypeRegistry) accessTypeName(code uint16, accessType uint16) string {
+	def, exists := r.accessType(code, accessType)
+	if !exists {
+		return strconv.Itoa(int(accessType))
+	}
+	return def.Name + " (" + def.Category + ", risk " + def.Risk + ")"
+}
+
+// Returns the registry entry of the code. A nil registry knows every code, but returns no entry
+func (r *DeviceTypeRegistry) lookup(code uint16) (*DeviceType, bool) {
+	if r == nil {
+		return nil, true
+	}
+	devType, exists := r.types[code]
+	return devType, exists
+}
+
+// Returns the name of the type for console and log output, falling back to the code for unknown types
+func (r *DeviceTypeRegistry) name(code uint16) string {
+	devType, exists := r.lookup(code)
+	if !exists || devType == nil {
+		return strconv.Itoa(int(code))
+	}
+	return devType.Name
+}
+
+// Checks a signup of the given type. Returns the reason code of the rejection, or SIGNUP_ACCEPTED
+func (r *DeviceTypeRegistry) checkSignup(code uint16, capURI []byte) uint8 {
+	devType, exists := r.lookup(code)
+	if !exists {
+		return SIGNUP_REJECT_UNKNOWN_TYPE
+	}
+	if devType != nil && devType.MaxCapURILen > 0 && len(capURI) > devType.MaxCapURILen {
+		return SIGNUP_REJECT_CAP_URI_TOO_LONG
+	}
+	return SIGNUP_ACCEPTED
+}
+
+// Returns the decision and reason code of the type's catalogue. Types without a registry entry use the built-in catalogue
+func (r *DeviceTypeRegistry) permits(code uint16, accessType uint16) (uint8, uint8) {
+	_, exists := r.accessType(code, accessType)
+	if !exists {
+		return DECISION_DENY, REASON_TYPE_UNSUPPORTED
+	}
+	return DECISION_ALLOW, REASON_NONE
+}
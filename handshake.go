@@ -0,0 +1,146 @@
+// Bounded pool of workers performing the X25519 handshake and key derivation of signups, such that a burst of onboarding does not stall the processor
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// A signup whose scan was found, waiting for a worker
+type HandshakeJob struct {
+	SignupReq SignupReq
+	Scan      Scan
+	Queued    time.Time
+}
+
+// Outcome of a handshake, committed to the registry by the processor
+type HandshakeResult struct {
+	SignupReq SignupReq
+	Scan      Scan
+	XP        []byte // Server's ephemeral public key, sent in the signup response
+	Sesskeys  Sessionkeys
+	Failed    bool // Set if the handshake failed, in which case only SignupReq and Scan are set and the signup is rejected
+}
+
+type HandshakePool struct {
+	// Metrics, updated atomically. NOTE: Kept first for the 64-bit alignment sync/atomic requires on 32-bit platforms
+	submitted uint64
+	rejected  uint64 // Signups rejected because the queue was full
+	completed uint64
+	failed    uint64
+	busy      int64  // Workers currently performing a handshake
+	waitNanos uint64 // Total time completed jobs spent queued
+	workNanos uint64 // Total time completed jobs spent in the handshake
+
+	workers int
+	jobs    chan HandshakeJob
+	Done    chan HandshakeResult // Reports completed handshakes to the processor
+}
+
+// Creates the pool and starts its workers. workers < 1 ==> One worker, queue < 1 ==> Room for one waiting signup
+func startHandshakePool(workers int, queue int) *HandshakePool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queue < 1 {
+		queue = 1
+	}
+
+	pool := &HandshakePool{workers: workers, jobs: make(chan HandshakeJob, queue), Done: make(chan HandshakeResult, queue)}
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+
+	fmt.Println("INFO, handshake: Started", workers, "handshake workers with a queue of", queue)
+	return pool
+}
+
+// Queues the handshake of the signup. Returns false if the queue is full, in which case the signup should be rejected
+func (p *HandshakePool) submit(signupReq SignupReq, scan Scan) bool {
+	select {
+	case p.jobs <- HandshakeJob{SignupReq: signupReq, Scan: scan, Queued: time.Now()}:
+		atomic.AddUint64(&p.submitted, 1)
+		return true
+	default:
+		atomic.AddUint64(&p.rejected, 1)
+		return false
+	}
+}
+
+func (p *HandshakePool) work() {
+	for job := range p.jobs {
+		started := time.Now()
+		atomic.AddInt64(&p.busy, 1)
+
+		result, ok := handshake(job)
+
+		atomic.AddInt64(&p.busy, -1)
+		if !ok {
+			atomic.AddUint64(&p.failed, 1)
+			p.Done <- HandshakeResult{SignupReq: job.SignupReq, Scan: job.Scan, Failed: true}
+			continue
+		}
+		atomic.AddUint64(&p.completed, 1)
+		atomic.AddUint64(&p.waitNanos, uint64(started.Sub(job.Queued)))
+		atomic.AddUint64(&p.workNanos, uint64(time.Since(started)))
+
+		p.Done <- result
+	}
+}
+
+// Performs the server's part of the handshake: ephemeral keypair, Diffie-Hellman with the gateway's static and ephemeral keys, key derivation
+func handshake(job HandshakeJob) (HandshakeResult, bool) {
+	sPubGw := job.SignupReq.SPubGW
+	ePubGw := job.SignupReq.EPubGw
+
+	// (1) Create local X25519 ephemeral keypair
+	xSlice, xP, err := createEphemeralKeyPair()
+	if !checkSuccessString("handshake, create Eph. keypair:", err) {
+		return HandshakeResult{}, false
+	}
+
+	var x [KEY_LEN]byte
+	copy(x[:], xSlice)
+
+	// (2) Perform Diffie-Hellman on the keypairs
+	s1, err := diffieHellman(x, sPubGw)
+	if !checkSuccessString("handshake, diffieHellman of s1:", err) {
+		return HandshakeResult{}, false
+	}
+
+	s2, err := diffieHellman(x, ePubGw)
+	if !checkSuccessString("handshake, diffieHellman of s2:", err) {
+		return HandshakeResult{}, false
+	}
+
+	// (3) Derive two keys, one for gw->server authentication and one for server->gw authentication
+	ikm := append(append(s1[:], s2[:]...), job.Scan.Psk[:]...)
+
+	var salt [16]byte
+
+	infos := make([][]byte, 2)
+
+	infos[0] = []byte("gw_s")
+	infos[1] = []byte("s_gw")
+
+	keys := Hkdf(ikm, salt, infos)
+
+	return HandshakeResult{SignupReq: job.SignupReq, Scan: job.Scan, XP: xP, Sesskeys: Sessionkeys{K_gw_s: keys[0], K_s_gw: keys[1]}}, true
+}
+
+// Prints the pool's metrics to the console
+func (p *HandshakePool) printMetrics() {
+	completed := atomic.LoadUint64(&p.completed)
+
+	var avgWait, avgWork time.Duration
+	if completed > 0 {
+		avgWait = time.Duration(atomic.LoadUint64(&p.waitNanos) / completed)
+		avgWork = time.Duration(atomic.LoadUint64(&p.workNanos) / completed)
+	}
+
+	fmt.Println("CONSOLE: - - - - - Handshake pool - - - - -")
+	fmt.Printf("Workers: %v, Busy: %v, Queued: %v / %v\n", p.workers, atomic.LoadInt64(&p.busy), len(p.jobs), cap(p.jobs))
+	fmt.Printf("Submitted: %v, Rejected (queue full): %v, Completed: %v, Failed: %v\n", atomic.LoadUint64(&p.submitted), atomic.LoadUint64(&p.rejected), completed, atomic.LoadUint64(&p.failed))
+	fmt.Printf("Average wait: %v, Average handshake: %v\n", avgWait, avgWork)
+}
@@ -7,6 +7,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/curve25519"
 )
@@ -33,6 +35,42 @@ func initSlice(s []byte, b byte) {
 	}
 }
 
+func containsUint16(s []uint16, v uint16) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsUint32(s []uint32, v uint32) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses a comma separated list of access type names, e.g. "SAMPLE_SENSOR_0,SAMPLE_SENSOR_1"
+func parseAccessTypeList(list string) ([]uint16, error) {
+	accessTypes := make([]uint16, 0)
+	if list == "" {
+		return accessTypes, nil
+	}
+
+	for _, name := range strings.Split(list, ",") {
+		accessType, exists := ACCESS_TYPE_NAMES[strings.TrimSpace(name)]
+		if !exists {
+			return nil, &UnknownAccessTypeName{Name: name}
+		}
+		accessTypes = append(accessTypes, accessType)
+	}
+
+	return accessTypes, nil
+}
+
 func buildHeader(headerBuf []byte, payloadType uint8) {
 	headerBuf[0] = payloadType
 	binary.LittleEndian.PutUint16(headerBuf[1:3], PAYLOAD_LENS[payloadType])
@@ -51,12 +89,23 @@ func buildMsg(outBuf []byte, payloadType uint8, payload []byte) {
 // }
 
 // Parameter index is the position in the log, starting at 0
-func (e *LogEntry) prettyPrint(index int) {
-	accessType := e.AuthReq.AccessType
+func (e *LogEntry) prettyPrint(accessTypeName string) {
 	arrivalTime := e.ArrivalTime
 	devId := e.DevId
 
-	fmt.Printf("Device ID: %v, Index: %v, Access Type: %v, Arrival time: %v\n", devId, index, accessType, arrivalTime)
+	fmt.Printf("Device ID: %v, Index: %v, Access Type: %v, Arrival time: %v\n", devId, e.Seq, accessTypeName, arrivalTime)
+	fmt.Printf("    Outcome: %v, Reason: %v, Latency: %v, Remote: %v, Connection: %v, Randomness hash: %x\n", LOG_OUTCOME_NAMES[e.Outcome], e.Reason, e.Latency, e.RemoteAddr, e.ConnId, e.RandomnessHash)
+	if e.Delegation != nil {
+		fmt.Printf("    Delegation: %v, Grantee: %v, Grantor: %v, Granted: %v\n", e.Delegation.Id, e.Delegation.Grantee, e.Delegation.Grantor, e.Granted)
+	}
+}
+
+// Records the outcome of the request and the time it took since its arrival
+func (e *LogEntry) settle(outcome uint8, reason uint8) {
+	e.Outcome = outcome
+	e.Reason = reason
+	e.Granted = outcome == LOG_OUTCOME_GRANTED
+	e.Latency = time.Since(e.ArrivalTime)
 }
 
 func createEphemeralKeyPair() ([]byte, []byte, error) {
@@ -154,3 +203,47 @@ func createSignupResp(devId uint32, ePubSRV []byte, ePubGW []byte, psk []byte) (
 
 	return msgBuf, nil
 }
+
+// Creates the authentication response and returns it together with the fresh randomness it carries
+func createAuthResp(decision uint8, reason uint8, reqMacTag []byte, authKey []byte) ([]byte, []byte, error) {
+
+	// (1) Create slice to MAC over. It holds:
+	//	   |  decision  |  reason  |  sRandom  |  authReq.macTag  |
+	respSlice := make([]byte, DECISION_LEN+REASON_LEN+RANDOM_LEN+HMAC_OUTPUT_SIZE)
+	respSlice[0] = decision
+	respSlice[DECISION_LEN] = reason
+
+	randomness := respSlice[DECISION_LEN+REASON_LEN : DECISION_LEN+REASON_LEN+RANDOM_LEN]
+	_, err := rand.Read(randomness)
+	if err != nil {
+		return nil, nil, err
+	}
+	copy(respSlice[DECISION_LEN+REASON_LEN+RANDOM_LEN:], reqMacTag)
+
+	// (2) Create authentication MAC tag over respSlice
+	authHmacer := hmac.New(sha256.New, authKey)
+
+	_, err = authHmacer.Write(respSlice)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	authTag := authHmacer.Sum(nil)
+
+	// (3) Create final response payload.
+	//	   We take the current respSlice:              |  decision  |  reason  |  sRandom  |  authReq.macTag  |
+	//	   and overwrite the old with the new MAC-Tag: |  decision  |  reason  |  sRandom  |     authTag      |
+	copy(respSlice[DECISION_LEN+REASON_LEN+RANDOM_LEN:], authTag)
+
+	// (4) Allocate message buffer, populate it to hold: |  header  |  decision  |  reason  |  sRandom  |  authTag  |
+	authMsg := make([]byte, HEADER_LEN+LEN_PAYLOAD_AUTH_RESP)
+	buildMsg(authMsg, PAYLOAD_AUTH_RESP, respSlice)
+
+	return authMsg, randomness, nil
+}
+
+func createSignupReject(reason uint8) []byte {
+	msgBuf := make([]byte, HEADER_LEN+LEN_PAYLOAD_SIGNUP_REJECT)
+	buildMsg(msgBuf, PAYLOAD_SIGNUP_REJECT, []byte{reason})
+	return msgBuf
+}
@@ -0,0 +1,102 @@
+// Allocation of device IDs, either sequential or random 32-bit. IDs of deleted devices are quarantined before they are handed out again,
+// such that a gateway still holding one cannot be confused with a new device
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const ID_RANDOM_ATTEMPTS = 64 // Random IDs drawn before the allocator falls back to searching the ID space
+
+// NOTE: Used by the processor only, which also applies the lifecycle operations
+type IdAllocator struct {
+	random     bool
+	next       uint32               // Next candidate of the sequential allocation
+	quarantine map[uint32]time.Time // IDs of deleted devices and when they may be handed out again
+	period     time.Duration
+	devices    *DeviceRegistry
+	store      *Store
+}
+
+// Creates the allocator, continuing after the state restored from the store
+func newIdAllocator(random bool, period time.Duration, next uint32, devices *DeviceRegistry, store *Store) *IdAllocator {
+	ids := &IdAllocator{random: random, next: next, quarantine: store.quarantined(), period: period, devices: devices, store: store}
+	if ids.quarantine == nil {
+		ids.quarantine = make(map[uint32]time.Time)
+	}
+	return ids
+}
+
+// Returns true if the ID may be handed out, i.e. it is neither in use, e.g. by a revoked device, nor quarantined
+func (ids *IdAllocator) free(devId uint32, now time.Time) bool {
+	if ids.devices.exists(devId) {
+		return false
+	}
+	until, quarantined := ids.quarantine[devId]
+	if quarantined && now.Before(until) {
+		return false
+	}
+	if quarantined {
+		delete(ids.quarantine, devId)
+	}
+	return true
+}
+
+// Returns an unused ID. The flag is unset if every ID is in use or quarantined
+func (ids *IdAllocator) allocate() (uint32, bool) {
+	now := time.Now()
+
+	// (1) Draw random IDs, a collision is unlikely unless the ID space is nearly exhausted
+	start := ids.next
+	if ids.random {
+		var buf [4]byte
+		for i := 0; i < ID_RANDOM_ATTEMPTS; i++ {
+			if _, err := rand.Read(buf[:]); !checkSuccessString("idalloc, drawing random ID", err) {
+				break
+			}
+			candidate := binary.LittleEndian.Uint32(buf[:])
+			if ids.free(candidate, now) {
+				return candidate, true
+			}
+			start = candidate
+		}
+		fmt.Println("WARNING, idalloc: No free random ID after", ID_RANDOM_ATTEMPTS, "attempts ==> Searching the ID space")
+	}
+
+	// (2) Search the ID space from the start, wrapping around. NOTE: Only sequential allocation after 2^32 IDs or a nearly full space gets here repeatedly
+	candidate := start
+	for {
+		if ids.free(candidate, now) {
+			if !ids.random {
+				ids.next = candidate + 1
+			}
+			return candidate, true
+		}
+		candidate += 1
+		if candidate == start {
+			fmt.Println("ERROR, idalloc: Every device ID is in use or quarantined")
+			return 0, false
+		}
+	}
+}
+
+// Takes back an ID allocated for a device which was never created, such that it is handed out next. It is not quarantined, as no gateway
+// learned it
+func (ids *IdAllocator) unallocate(devId uint32) {
+	if !ids.random && ids.next == devId+1 {
+		ids.next = devId
+	}
+}
+
+// Quarantines the ID of a deleted device. Returns false if it could not be persisted
+func (ids *IdAllocator) release(devId uint32) bool {
+	until := time.Now().Add(ids.period)
+	if !ids.store.putQuarantine(devId, until) {
+		return false
+	}
+	ids.quarantine[devId] = until
+	return true
+}
@@ -0,0 +1,103 @@
+// Safety interlocks, denying requests while other devices have recently been granted conflicting requests
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// An interlock rule, e.g. "no CONTROL_ACTUATOR_0 on the window controller (device 4) while the alarm device (device 7) has been granted CONTROL_ACTUATOR_1
+// in the last 10 minutes":
+//
+//	{ "devIds": [4], "accessTypes": ["CONTROL_ACTUATOR_0"],
+//	  "blockedBy": { "devIds": [7], "accessTypes": ["CONTROL_ACTUATOR_1"] }, "within": "10m",
+//	  "description": "Windows stay closed while the alarm is active" }
+//
+// The rule guards the requests it matches. Granted requests of any OTHER device matched by blockedBy within the given duration block them
+type InterlockRule struct {
+	PolicyMatch
+	BlockedBy   PolicyMatch `json:"blockedBy"`
+	Within      string      `json:"within"`      // Go duration, e.g. "10m"
+	Description string      `json:"description"` // Explanation logged whenever the interlock denies a request
+
+	within time.Duration
+}
+
+func (r *InterlockRule) resolve(path string) error {
+	err := r.PolicyMatch.resolve(path)
+	if err != nil {
+		return err
+	}
+
+	err = r.BlockedBy.resolve(path)
+	if err != nil {
+		return err
+	}
+
+	r.within, err = time.ParseDuration(r.Within)
+	if err != nil || r.within <= 0 {
+		return &InvalidPolicy{Path: path, Reason: "invalid within \"" + r.Within + "\""}
+	}
+
+	return nil
+}
+
+// Returns the ID of another device with a granted request matched by blockedBy in the rule's window before arrival, if any. NOTE: Requests
+// granted meanwhile, i.e. arriving after this one, block it as well
+func (r *InterlockRule) blockingDevice(devices *DeviceRegistry, devId uint32, arrival time.Time) (uint32, bool) {
+	since := arrival.Add(-r.within)
+
+	blocks := func(otherState *DeviceState) bool {
+		return otherState.Id != devId && otherState.Log.grantedSince(since, func(accessType uint16) bool { return r.BlockedBy.matches(otherState, accessType) })
+	}
+
+	// (1) Rules naming the blocking devices only look at them
+	if len(r.BlockedBy.DevIds) > 0 {
+		for _, otherId := range r.BlockedBy.DevIds {
+			if otherId == devId {
+				continue
+			}
+			otherState, exists := devices.get(otherId)
+			if exists && blocks(&otherState) {
+				return otherId, true
+			}
+		}
+		return 0, false
+	}
+
+	// (2) Others look at every device, each at the cost of its access types
+	var (
+		blockingId uint32
+		blocked    bool
+	)
+	devices.forEach(func(otherState *DeviceState) bool {
+		if blocks(otherState) {
+			blockingId, blocked = otherState.Id, true
+		}
+		return !blocked
+	})
+
+	return blockingId, blocked
+}
+
+// Returns the decision and reason code of the interlocks for a request arriving at the given time. No matching interlock may be engaged
+func (p *PolicyEngine) checkInterlocks(devices *DeviceRegistry, devState *DeviceState, accessType uint16, arrival time.Time) (uint8, uint8) {
+	if p == nil {
+		return DECISION_ALLOW, REASON_NONE
+	}
+
+	for i := range p.Interlocks {
+		rule := &p.Interlocks[i]
+		if !rule.matches(devState, accessType) {
+			continue
+		}
+
+		blockingId, blocked := rule.blockingDevice(devices, devState.Id, arrival)
+		if blocked {
+			fmt.Println("INFO, interlock: Access type", accessType, "of device", devState.Id, "blocked by recent request of device", blockingId, "==>", rule.Description)
+			return DECISION_DENY, REASON_INTERLOCK
+		}
+	}
+
+	return DECISION_ALLOW, REASON_NONE
+}
@@ -0,0 +1,248 @@
+// Exclusive leases on physical actuators shared by several devices
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Outcomes of trying to acquire a lease
+const (
+	LEASE_NOT_REQUIRED = iota // No lease definition matches the request
+	LEASE_ACQUIRED            // The device holds the lease now, either freshly or renewed
+	LEASE_BUSY                // Another device holds the lease ==> Deny
+	LEASE_QUEUED              // Another device holds the lease ==> The request waits for the lease
+)
+
+// Defines which requests need the named lease:
+//
+//	{ "name": "garage-door", "devIds": [3, 5], "accessTypes": ["CONTROL_ACTUATOR_0"], "ttl": "30s", "queue": true }
+//
+// Without queue, requests of other devices are denied while the lease is held
+type LeaseDef struct {
+	PolicyMatch
+	Name  string `json:"name"`
+	TTL   string `json:"ttl"` // Go duration, e.g. "30s"
+	Queue bool   `json:"queue"`
+
+	ttl time.Duration
+}
+
+type Lease struct {
+	Name       string
+	Holder     uint32
+	AccessType uint16
+	Expires    time.Time
+
+	generation uint64 // Distinguishes the expiry timers of renewals
+}
+
+type LeaseExpiry struct {
+	Name       string
+	Generation uint64
+}
+
+// A request waiting for a lease held by another device
+type QueuedRequest struct {
+	AuthReq  AuthReq
+	LogSeq   uint64
+	QueuedAt time.Time
+}
+
+type LeaseManager struct {
+	mu             sync.Mutex
+	defs           []LeaseDef
+	held           map[string]*Lease
+	queues         map[string][]QueuedRequest
+	nextGeneration uint64
+
+	Expired chan LeaseExpiry // Reports expired leases to the processor
+}
+
+// Lease file layout:
+//
+//	{ "leases": [ { "name": "garage-door", ... }, ... ] }
+func loadLeases(path string) (*LeaseManager, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Leases []LeaseDef `json:"leases"`
+	}
+	err = json.Unmarshal(raw, &file)
+	if err != nil {
+		return nil, &InvalidPolicy{Path: path, Reason: err.Error()}
+	}
+
+	names := make(map[string]bool)
+	for i := range file.Leases {
+		def := &file.Leases[i]
+
+		if def.Name == "" || names[def.Name] {
+			return nil, &InvalidPolicy{Path: path, Reason: "lease names must be non-empty and unique, got \"" + def.Name + "\""}
+		}
+		names[def.Name] = true
+
+		err = def.resolve(path)
+		if err != nil {
+			return nil, err
+		}
+
+		def.ttl, err = time.ParseDuration(def.TTL)
+		if err != nil || def.ttl <= 0 {
+			return nil, &InvalidPolicy{Path: path, Reason: "invalid ttl \"" + def.TTL + "\""}
+		}
+	}
+
+	return &LeaseManager{
+		defs:    file.Leases,
+		held:    make(map[string]*Lease),
+		queues:  make(map[string][]QueuedRequest),
+		Expired: make(chan LeaseExpiry, 1000),
+	}, nil
+}
+
+// Gives the lease to the device until now + ttl and arms the expiry timer. The caller must hold the lock
+func (m *LeaseManager) take(def *LeaseDef, devId uint32, accessType uint16, now time.Time) {
+	generation := m.nextGeneration
+	m.nextGeneration += 1
+
+	m.held[def.Name] = &Lease{Name: def.Name, Holder: devId, AccessType: accessType, Expires: now.Add(def.ttl), generation: generation}
+
+	name := def.Name
+	time.AfterFunc(def.ttl, func() {
+		m.Expired <- LeaseExpiry{Name: name, Generation: generation}
+	})
+}
+
+// Tries to acquire the lease the request needs, if any, for the requesting device. The definitions are matched against the actuator's state,
+// which is the grantor's for a request using a delegation. Queued requests are stored under the lease name returned
+func (m *LeaseManager) acquire(actuatorState *DeviceState, authReq AuthReq, logSeq uint64, now time.Time) (int, string) {
+	if m == nil {
+		return LEASE_NOT_REQUIRED, ""
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// (1) Find the lease the request needs. The first matching definition counts
+	var def *LeaseDef
+	for i := range m.defs {
+		if m.defs[i].matches(actuatorState, authReq.AccessType) {
+			def = &m.defs[i]
+			break
+		}
+	}
+	if def == nil {
+		return LEASE_NOT_REQUIRED, ""
+	}
+
+	// (2) Free or held by the same device ==> Take or renew it
+	lease, held := m.held[def.Name]
+	if !held || lease.Holder == authReq.DevId {
+		m.take(def, authReq.DevId, authReq.AccessType, now)
+		return LEASE_ACQUIRED, def.Name
+	}
+
+	// (3) Held by another device
+	if !def.Queue {
+		return LEASE_BUSY, def.Name
+	}
+
+	m.queues[def.Name] = append(m.queues[def.Name], QueuedRequest{AuthReq: authReq, LogSeq: logSeq, QueuedAt: now})
+	return LEASE_QUEUED, def.Name
+}
+
+// Frees the lease if the expiry belongs to its current holder, i.e. it was not renewed since. Returns true if the lease was freed
+func (m *LeaseManager) expire(expiry LeaseExpiry) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lease, held := m.held[expiry.Name]
+	if !held || lease.generation != expiry.Generation {
+		return false
+	}
+
+	delete(m.held, expiry.Name)
+	return true
+}
+
+// Frees the lease regardless of its holder. Returns true if the lease was held
+func (m *LeaseManager) release(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, held := m.held[name]
+	delete(m.held, name)
+	return held
+}
+
+// Frees the leases held by the device and returns their names. A nil manager holds no leases
+func (m *LeaseManager) releaseHeldBy(devId uint32) []string {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var names []string
+	for name, lease := range m.held {
+		if lease.Holder == devId {
+			delete(m.held, name)
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Pops the oldest request waiting for the free lease and gives the lease to its device. Returns false if none waits or the lease is not free
+func (m *LeaseManager) handOff(name string, now time.Time) (QueuedRequest, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, held := m.held[name]
+	queue := m.queues[name]
+	if held || len(queue) == 0 {
+		return QueuedRequest{}, false
+	}
+
+	next := queue[0]
+	m.queues[name] = queue[1:]
+
+	for i := range m.defs {
+		if m.defs[i].Name == name {
+			m.take(&m.defs[i], next.AuthReq.DevId, next.AuthReq.AccessType, now)
+		}
+	}
+
+	return next, true
+}
+
+// Prints the held leases and their queues to the console
+func (m *LeaseManager) printLeases() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.defs))
+	for i := range m.defs {
+		names = append(names, m.defs[i].Name)
+	}
+	sort.Strings(names)
+
+	fmt.Println("CONSOLE: - - - - - Leases - - - - -")
+	for _, name := range names {
+		lease, held := m.held[name]
+		if !held {
+			fmt.Printf("Lease: %v, free, Queued: %v\n", name, len(m.queues[name]))
+			continue
+		}
+		fmt.Printf("Lease: %v, Holder: %v, Access Type: %v, Expires in: %v, Queued: %v\n", name, lease.Holder, lease.AccessType, time.Until(lease.Expires).Round(time.Second), len(m.queues[name]))
+	}
+}
@@ -0,0 +1,129 @@
+// Lifecycle of a device after its signup: suspended devices are denied but keep their keys, revoked devices lose their keys and their ID is
+// blocklisted, deleted devices are purged
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Lifecycle operations, issued on the console
+const (
+	LIFECYCLE_SUSPEND = iota // Authentication requests are denied with REASON_SUSPENDED until the device is resumed
+	LIFECYCLE_RESUME         // Undoes a suspension
+	LIFECYCLE_REVOKE         // Destroys the keys, closes the connection and keeps the ID as tombstone, such that its requests are dropped unverified
+	LIFECYCLE_DELETE         // Purges the device's state, log and statistics. The ID is quarantined, see idalloc.go
+)
+
+var LIFECYCLE_NAMES []string = []string{"suspend", "resume", "revoke", "delete"}
+
+type LifecycleCmd struct {
+	Op    uint8
+	DevId uint32
+}
+
+// Applies the lifecycle operation. Runs in the processor, which owns the scans
+func applyLifecycle(cfg *Config, devices *DeviceRegistry, owner *HomeOwner, shards *AuthShards, scans Scans, ids *IdAllocator, cmd LifecycleCmd) {
+	devState, exists := devices.get(cmd.DevId)
+	if !exists {
+		fmt.Println("WARNING, lifecycle: Cannot", LIFECYCLE_NAMES[cmd.Op], "unknown device", cmd.DevId)
+		return
+	}
+	if devState.Status == DEVICE_REVOKED && cmd.Op != LIFECYCLE_DELETE {
+		fmt.Println("WARNING, lifecycle: Device", cmd.DevId, "is revoked, it can only be deleted")
+		return
+	}
+
+	switch cmd.Op {
+	case LIFECYCLE_SUSPEND, LIFECYCLE_RESUME:
+		status := uint8(DEVICE_SUSPENDED)
+		if cmd.Op == LIFECYCLE_RESUME {
+			status = DEVICE_ACTIVE
+		}
+		if !devices.commit(cfg.Store, cmd.DevId, func(devState *DeviceState) { devState.Status = status }) {
+			return
+		}
+
+	case LIFECYCLE_REVOKE:
+		// (1) Destroy the keys and mark the ID as revoked. NOTE: Persisted first, such that a restart never brings the keys back
+		if !devices.commit(cfg.Store, cmd.DevId, func(devState *DeviceState) {
+			devState.Status = DEVICE_REVOKED
+			devState.Sesskeys = Sessionkeys{}
+			devState.LastRandomness = nil
+			devState.ScanData = Scan{}
+			devState.Owner, devState.Pending, devState.Paired = false, false, false
+			devState.Conn = nil
+		}) {
+			return
+		}
+
+		// (1.1) Rewrite the store, such that the older records holding the keys are gone. NOTE: On failure they remain until the next snapshot,
+		//		 the revocation takes effect nevertheless
+		cfg.Store.compact()
+
+		// (2) Close the connection, such that the gateway has to reconnect and sign up again
+		if devState.Conn != nil {
+			checkSuccessString("lifecycle, closing connection", devState.Conn.Close())
+		}
+
+		forgetDevice(cfg, devices, owner, shards, scans, devState)
+
+	case LIFECYCLE_DELETE:
+		// (1) Quarantine the ID first, such that it is not handed out again right away also if the server crashes in between
+		if !ids.release(cmd.DevId) {
+			return
+		}
+
+		// (2) Remove the device, the log and the statistics
+		if !devices.remove(cfg.Store, cmd.DevId) {
+			return
+		}
+		cfg.Store.compact() // Drops the older records of the device, as for a revocation
+		if devState.Conn != nil {
+			checkSuccessString("lifecycle, closing connection", devState.Conn.Close())
+		}
+		cfg.LogArchive.purge(cmd.DevId)
+		cfg.RateLimiter.forget(cmd.DevId)
+		cfg.Anomalies.forget(cmd.DevId)
+
+		forgetDevice(cfg, devices, owner, shards, scans, devState)
+	}
+
+	fmt.Println("INFO, lifecycle: Applied", LIFECYCLE_NAMES[cmd.Op], "to device", cmd.DevId)
+}
+
+// Removes what refers to a revoked or deleted device: its scan, its role as home owner device, its delegations and its leases
+func forgetDevice(cfg *Config, devices *DeviceRegistry, owner *HomeOwner, shards *AuthShards, scans Scans, devState DeviceState) {
+
+	// (1) The scan is removed, such that the gateway cannot sign up again unless it is scanned again
+	if _, exists := scans[devState.ScanData.SPubGW]; exists && cfg.Store.deleteScan(devState.ScanData.SPubGW) {
+		delete(scans, devState.ScanData.SPubGW)
+	}
+
+	// (2) The device loses the role of home owner device. The next one is only designated on the console, see HomeOwner.clear
+	owner.clear(devState.Id)
+
+	// (3) Delegations from and to the device end
+	cfg.Delegations.forget(cfg.Store, devState.Id)
+
+	// (4) Leases held by the device are passed on
+	for _, name := range cfg.Leases.releaseHeldBy(devState.Id) {
+		handOffLease(cfg, devices, shards, name)
+	}
+}
+
+// Deletes the device's segments and checkpoints. A nil archive holds nothing
+func (a *LogArchive) purge(devId uint32) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if segment, exists := a.open[devId]; exists {
+		segment.file.Close()
+		delete(a.open, devId)
+	}
+	checkSuccessString("lifecycle, deleting log", os.RemoveAll(a.deviceDir(devId)))
+}
@@ -0,0 +1,562 @@
+// Bounded per-device logs: a ring buffer of the recent entries in memory, older entries spilled to per-device JSONL segment files
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LOG_PAGE_SIZE          = 50                  // Entries printed per page on the console
+	LOG_RETENTION_INTERVAL = time.Minute         // Interval in which the retention policy is applied to the segment files
+	LOG_CHECKPOINT_FILE    = "checkpoints.jsonl" // Per device, next to the segments
+)
+
+// Log of a single device. Entries are numbered by a sequence number which never decreases, also across spills and restarts.
+// NOTE: Safe for concurrent use, copies of a DeviceState share the log
+type DeviceLog struct {
+	mu      sync.Mutex
+	devId   uint32
+	buf     []LogEntry // Ring buffer, the entry with sequence number seq is at buf[seq % cap(buf)]
+	held    int        // Number of entries in buf
+	next    uint64     // Sequence number of the next entry
+	archive *LogArchive
+	chain   *logChain // Hash chain and checkpoints, see logchain.go
+
+	granted map[uint16]time.Time // Arrival time of the latest granted entry per access type, for the interlocks and schedules
+}
+
+// Creates the log of the device, holding up to capacity entries in memory. Sequence numbers and the hash chain continue after the entries spilled
+// before a restart, as far as retention kept them. key MACs the checkpoints
+func newDeviceLog(devId uint32, capacity int, archive *LogArchive, key []byte) *DeviceLog {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	next, head := archive.tail(devId)
+	checkpoints := archive.checkpoints(devId)
+
+	// Never reuse a sequence number a checkpoint committed to. NOTE: Only after a crash the archive ends before the last checkpoint,
+	// the lost entries then show as missing in verify-log
+	if len(checkpoints) > 0 {
+		last := checkpoints[len(checkpoints)-1]
+		if last.FirstSeq+last.Count > next {
+			fmt.Println("WARNING, log: Entries", next, "to", last.FirstSeq+last.Count-1, "of device", devId, "were committed to but never spilled ==> Continuing after them")
+			next = last.FirstSeq + last.Count
+		}
+	}
+	chain := &logChain{key: key, sealed: next, head: head, leavesFrom: next, checkpoints: checkpoints}
+
+	// The spilled entries sealed after the last checkpoint are committed to by the next one, unless retention deleted some
+	if len(chain.checkpoints) > 0 {
+		last := chain.checkpoints[len(chain.checkpoints)-1]
+		from := last.FirstSeq + last.Count
+		if from < next && next-from <= LOG_CHECKPOINT_ENTRIES {
+			uncommitted := archive.read(devId, from, int(next-from))
+			if uint64(len(uncommitted)) == next-from && uncommitted[0].Seq == from {
+				for _, entry := range uncommitted {
+					chain.leaves = append(chain.leaves, entry.Hash)
+				}
+				chain.leavesFrom = from
+			}
+		}
+	}
+
+	return &DeviceLog{devId: devId, buf: make([]LogEntry, capacity), next: next, archive: archive, chain: chain, granted: archive.lastGranted(devId)}
+}
+
+// Index of the oldest entry still in memory. The caller must hold the lock
+func (l *DeviceLog) oldest() uint64 {
+	return l.next - uint64(l.held)
+}
+
+// Appends the entry and returns its sequence number. If the buffer is full, the oldest entry is spilled to the archive, or dropped without one
+func (l *DeviceLog) append(entry LogEntry) uint64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.Seq = l.next
+	entry.PrevHash, entry.Hash = nil, nil
+	if l.held < cap(l.buf) {
+		// NOTE: Placed by sequence number, as the log may start at any sequence number after a restart
+		l.buf[l.next%uint64(cap(l.buf))] = entry
+		l.held += 1
+	} else {
+		// NOTE: Spilled under the lock, such that every entry older than oldest() is in the archive once the lock is released.
+		//	   It is sealed first, also if its outcome is still pending, as it cannot change anymore once spilled
+		slot := &l.buf[l.next%uint64(cap(l.buf))]
+		l.seal(slot.Seq + 1)
+		l.archive.spill(l.devId, slot)
+		*slot = entry
+	}
+	l.next += 1
+	l.noteGranted(&entry)
+	l.seal(0)
+
+	return entry.Seq
+}
+
+// Keeps the arrival time of the entry if it is granted and the latest of its access type. The caller must hold the lock
+func (l *DeviceLog) noteGranted(entry *LogEntry) {
+	accessType := entry.AuthReq.AccessType
+	if entry.Granted && entry.ArrivalTime.After(l.granted[accessType]) {
+		l.granted[accessType] = entry.ArrivalTime
+	}
+}
+
+// Returns the arrival time of the latest granted entry of the access type, see grantedSince
+func (l *DeviceLog) lastGranted(accessType uint16) (time.Time, bool) {
+	if l == nil {
+		return time.Time{}, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	arrival, exists := l.granted[accessType]
+	return arrival, exists
+}
+
+// Returns true if an entry of an access type accepted by fn was granted at or after since. Unlike walking the entries, it costs no more for longer logs
+// and also covers spilled entries, including those spilled before a restart
+func (l *DeviceLog) grantedSince(since time.Time, fn func(accessType uint16) bool) bool {
+	if l == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for accessType, arrival := range l.granted {
+		if !arrival.Before(since) && fn(accessType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs fn on the entry with the sequence number. Returns false if the entry is no longer in memory, in which case the change is lost.
+// NOTE: Entries must only be changed while their outcome is pending, once it is set they are sealed into the hash chain
+func (l *DeviceLog) update(seq uint64, fn func(entry *LogEntry)) bool {
+	if l == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if seq < l.oldest() || seq >= l.next {
+		return false
+	}
+	entry := &l.buf[seq%uint64(cap(l.buf))]
+	fn(entry)
+	l.noteGranted(entry)
+	l.seal(0)
+	return true
+}
+
+// Records the outcome of the entry with the sequence number, see update
+func (l *DeviceLog) settle(seq uint64, outcome uint8, reason uint8) bool {
+	return l.update(seq, func(entry *LogEntry) { entry.settle(outcome, reason) })
+}
+
+// Returns the sequence number of the next entry
+func (l *DeviceLog) length() uint64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.next
+}
+
+// Returns up to n entries starting at sequence number from, read from the archive where they are no longer in memory
+func (l *DeviceLog) page(from uint64, n int) []LogEntry {
+	if l == nil {
+		return nil
+	}
+
+	// (1) Copy the requested entries still in memory
+	l.mu.Lock()
+	oldest := l.oldest()
+	var buffered []LogEntry
+	for seq := from; seq < l.next && seq < from+uint64(n); seq++ {
+		if seq >= oldest {
+			buffered = append(buffered, l.buf[seq%uint64(cap(l.buf))])
+		}
+	}
+	l.mu.Unlock()
+
+	// (2) Read the older ones from the segment files. NOTE: Entries retention removed already are skipped
+	var entries []LogEntry
+	if from < oldest {
+		count := n
+		if oldest-from < uint64(n) {
+			count = int(oldest - from)
+		}
+		entries = l.archive.read(l.devId, from, count)
+	}
+
+	return append(entries, buffered...)
+}
+
+// Spills every entry in memory to the archive and commits to them, e.g. on shutdown, such that the next start continues after them. Pending
+// entries are sealed as they are. NOTE: The log stays locked, such that no entry is appended anymore before the server exits
+func (l *DeviceLog) close() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+
+	l.seal(l.next)
+	for seq := l.oldest(); seq < l.next; seq++ {
+		l.archive.spill(l.devId, &l.buf[seq%uint64(cap(l.buf))])
+	}
+	l.held = 0
+	l.checkpointLocked()
+}
+
+// Spills the logs of every device and closes the archive, once the server shuts down. Later appends block
+func closeLogs(archive *LogArchive, devices *DeviceRegistry) {
+	devices.forEach(func(devState *DeviceState) bool {
+		devState.Log.close()
+		return true
+	})
+	archive.close()
+}
+
+// Segment files of the device logs, in one directory per device. Each segment is named after the sequence number of its first entry
+type LogArchive struct {
+	mu          sync.Mutex
+	dir         string
+	segmentSize int64         // Size after which a new segment is started
+	maxAge      time.Duration // Segments last written to before are deleted, 0 ==> No limit
+	maxBytes    int64         // Per device, the oldest segments are deleted beyond, 0 ==> No limit
+	open        map[uint32]*logSegment
+}
+
+type logSegment struct {
+	file     *os.File
+	firstSeq uint64
+	size     int64
+}
+
+// Opens the archive in the directory, creating it as needed, and starts applying the retention policy
+func openLogArchive(dir string, segmentSize int64, maxAge time.Duration, maxBytes int64) (*LogArchive, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &LogArchive{dir: dir, segmentSize: segmentSize, maxAge: maxAge, maxBytes: maxBytes, open: make(map[uint32]*logSegment)}
+
+	if maxAge > 0 || maxBytes > 0 {
+		go func() {
+			for range time.Tick(LOG_RETENTION_INTERVAL) {
+				a.retain()
+			}
+		}()
+	}
+
+	return a, nil
+}
+
+func (a *LogArchive) deviceDir(devId uint32) string {
+	return filepath.Join(a.dir, fmt.Sprint(devId))
+}
+
+func segmentName(firstSeq uint64) string {
+	return fmt.Sprintf("%020d.jsonl", firstSeq)
+}
+
+// Returns the first sequence numbers of the device's segments in ascending order. The caller must hold the lock
+func (a *LogArchive) segments(devId uint32) []uint64 {
+	files, err := os.ReadDir(a.deviceDir(devId))
+	if err != nil {
+		return nil
+	}
+
+	var firstSeqs []uint64
+	for _, file := range files {
+		firstSeq, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ".jsonl"), 10, 64)
+		if err == nil && strings.HasSuffix(file.Name(), ".jsonl") {
+			firstSeqs = append(firstSeqs, firstSeq)
+		}
+	}
+	sort.Slice(firstSeqs, func(i, j int) bool { return firstSeqs[i] < firstSeqs[j] })
+	return firstSeqs
+}
+
+// Returns the sequence number following the last entry spilled for the device and that entry's hash. A nil archive starts every log at 0
+func (a *LogArchive) tail(devId uint32) (uint64, []byte) {
+	if a == nil {
+		return 0, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	firstSeqs := a.segments(devId)
+	if len(firstSeqs) == 0 {
+		return 0, nil
+	}
+
+	next := firstSeqs[len(firstSeqs)-1]
+	var head []byte
+	a.scan(devId, firstSeqs[len(firstSeqs)-1], func(entry *LogEntry) bool {
+		next, head = entry.Seq+1, entry.Hash
+		return true
+	})
+	return next, head
+}
+
+// Returns the arrival time of the latest granted entry per access type among the device's spilled entries, such that a restart does not
+// forget recent grants. NOTE: Reads every segment retention kept, once when the log is created
+func (a *LogArchive) lastGranted(devId uint32) map[uint16]time.Time {
+	granted := make(map[uint16]time.Time)
+	if a == nil {
+		return granted
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, firstSeq := range a.segments(devId) {
+		a.scan(devId, firstSeq, func(entry *LogEntry) bool {
+			accessType := entry.AuthReq.AccessType
+			if entry.Granted && entry.ArrivalTime.After(granted[accessType]) {
+				granted[accessType] = entry.ArrivalTime
+			}
+			return true
+		})
+	}
+	return granted
+}
+
+// Appends the checkpoint to the device's checkpoint file. A nil archive keeps checkpoints in memory only
+func (a *LogArchive) putCheckpoint(checkpoint LogCheckpoint) {
+	if a == nil {
+		return
+	}
+
+	line, err := json.Marshal(checkpoint)
+	if !checkSuccessString("log, encoding checkpoint", err) {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	err = os.MkdirAll(a.deviceDir(checkpoint.DevId), 0700)
+	if !checkSuccessString("log, creating segment directory", err) {
+		return
+	}
+	file, err := os.OpenFile(filepath.Join(a.deviceDir(checkpoint.DevId), LOG_CHECKPOINT_FILE), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if !checkSuccessString("log, opening checkpoint file", err) {
+		return
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	checkSuccessString("log, appending checkpoint", err)
+}
+
+// Returns the device's checkpoints in order
+func (a *LogArchive) checkpoints(devId uint32) []LogCheckpoint {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, err := os.Open(filepath.Join(a.deviceDir(devId), LOG_CHECKPOINT_FILE))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var checkpoints []LogCheckpoint
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var checkpoint LogCheckpoint
+		if json.Unmarshal(scanner.Bytes(), &checkpoint) == nil {
+			checkpoints = append(checkpoints, checkpoint)
+		}
+	}
+	return checkpoints
+}
+
+// Appends the entry to the device's current segment, starting a new one once it is full. A nil archive drops the entry
+func (a *LogArchive) spill(devId uint32, entry *LogEntry) {
+	if a == nil {
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if !checkSuccessString("log, encoding spilled entry", err) {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// (1) Start a new segment if there is none yet or the current one is full
+	segment, exists := a.open[devId]
+	if exists && segment.size >= a.segmentSize {
+		segment.file.Close()
+		delete(a.open, devId)
+		exists = false
+	}
+	if !exists {
+		err = os.MkdirAll(a.deviceDir(devId), 0700)
+		if !checkSuccessString("log, creating segment directory", err) {
+			return
+		}
+		file, err := os.OpenFile(filepath.Join(a.deviceDir(devId), segmentName(entry.Seq)), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if !checkSuccessString("log, creating segment", err) {
+			return
+		}
+		segment = &logSegment{file: file, firstSeq: entry.Seq}
+		a.open[devId] = segment
+	}
+
+	// (2) Append the entry. NOTE: Not synced, a crash loses at most the entries the OS did not write yet
+	n, err := segment.file.Write(append(line, '\n'))
+	segment.size += int64(n)
+	checkSuccessString("log, appending to segment", err)
+}
+
+// Syncs and closes the open segments
+func (a *LogArchive) close() {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for devId, segment := range a.open {
+		checkSuccessString("log, syncing segment", segment.file.Sync())
+		segment.file.Close()
+		delete(a.open, devId)
+	}
+}
+
+// Runs fn on the entries of the segment in order until fn returns false. The caller must hold the lock.
+// NOTE: Lines which cannot be decoded are skipped and reported, they are either torn by a crash or evidence of tampering
+func (a *LogArchive) scan(devId uint32, firstSeq uint64, fn func(entry *LogEntry) bool) {
+	file, err := os.Open(filepath.Join(a.deviceDir(devId), segmentName(firstSeq)))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry LogEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			fmt.Println("WARNING, log: Line", line, "of segment", firstSeq, "of device", devId, "is corrupt ==> Skipped, see verify-log")
+			continue
+		}
+		if !fn(&entry) {
+			return
+		}
+	}
+	checkSuccessString("log, reading segment", scanner.Err())
+}
+
+// Returns up to n spilled entries of the device starting at sequence number from
+func (a *LogArchive) read(devId uint32, from uint64, n int) []LogEntry {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var entries []LogEntry
+	firstSeqs := a.segments(devId)
+	for i, firstSeq := range firstSeqs {
+		// Skip the segments ending before from
+		if i+1 < len(firstSeqs) && firstSeqs[i+1] <= from {
+			continue
+		}
+
+		a.scan(devId, firstSeq, func(entry *LogEntry) bool {
+			if entry.Seq >= from {
+				entries = append(entries, *entry)
+			}
+			return len(entries) < n
+		})
+		if len(entries) >= n {
+			break
+		}
+	}
+	return entries
+}
+
+// Deletes the segments beyond the maximum age or, oldest first, beyond the maximum size per device
+func (a *LogArchive) retain() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	dirs, err := os.ReadDir(a.dir)
+	if !checkSuccessString("log, listing archive", err) {
+		return
+	}
+
+	for _, dir := range dirs {
+		devId, err := strconv.ParseUint(dir.Name(), 10, 32)
+		if err != nil || !dir.IsDir() {
+			continue
+		}
+
+		// (1) Gather the segments' sizes and modification times, newest first
+		firstSeqs := a.segments(uint32(devId))
+		infos := make([]os.FileInfo, len(firstSeqs))
+		for i, firstSeq := range firstSeqs {
+			infos[i], _ = os.Stat(filepath.Join(a.deviceDir(uint32(devId)), segmentName(firstSeq)))
+		}
+
+		// (2) Keep the newest segments within the limits, delete the rest
+		var total int64
+		for i := len(firstSeqs) - 1; i >= 0; i-- {
+			if infos[i] == nil {
+				continue
+			}
+			total += infos[i].Size()
+
+			tooOld := a.maxAge > 0 && time.Since(infos[i].ModTime()) > a.maxAge
+			tooLarge := a.maxBytes > 0 && total > a.maxBytes
+			if !tooOld && !tooLarge {
+				continue
+			}
+
+			if segment, exists := a.open[uint32(devId)]; exists && segment.firstSeq == firstSeqs[i] {
+				segment.file.Close()
+				delete(a.open, uint32(devId))
+			}
+			err = os.Remove(filepath.Join(a.deviceDir(uint32(devId)), segmentName(firstSeqs[i])))
+			if checkSuccessString("log, deleting segment", err) {
+				fmt.Println("INFO, log: Retention deleted segment", firstSeqs[i], "of device", devId)
+			}
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_LOG_DEVICE   = 1
+	TEST_LOG_ENTRIES  = LOG_CHECKPOINT_ENTRIES + 16 // One full checkpoint and one taken on closing
+	TEST_LOG_CAPACITY = 8
+)
+
+// Fills a log of TEST_LOG_ENTRIES entries and closes it, such that every entry is spilled to the archive's single segment and committed to
+func archivedLog(t *testing.T) (*LogArchive, []byte) {
+	archive, err := openLogArchive(t.TempDir(), 1<<30, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(archive.close)
+	key, err := newLogKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := newDeviceLog(TEST_LOG_DEVICE, TEST_LOG_CAPACITY, archive, key)
+	for i := 0; i < TEST_LOG_ENTRIES; i++ {
+		entry := LogEntry{ArrivalTime: time.Now(), DevId: TEST_LOG_DEVICE, Paired: true, Outcome: LOG_OUTCOME_DENIED, Reason: REASON_RATE_LIMITED,
+			AuthReq: AuthReq{DevId: TEST_LOG_DEVICE, AccessType: SAMPLE_SENSOR_0, ReqCnt: uint32(i + 1)}}
+		if i%2 == 0 {
+			entry.Granted, entry.Outcome, entry.Reason = true, LOG_OUTCOME_GRANTED, REASON_NONE
+		}
+		log.append(entry)
+	}
+	log.close()
+	archive.close()
+	return archive, key
+}
+
+// Rewrites the lines of the archived segment with fn
+func editSegment(t *testing.T, archive *LogArchive, fn func(lines [][]byte) [][]byte) {
+	path := filepath.Join(archive.deviceDir(TEST_LOG_DEVICE), segmentName(0))
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := fn(bytes.Split(bytes.TrimSuffix(raw, []byte("\n")), []byte("\n")))
+	err = os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Changes the archived entry on the line with fn
+func editEntry(t *testing.T, lines [][]byte, line int, fn func(entry *LogEntry)) [][]byte {
+	var entry LogEntry
+	err := json.Unmarshal(lines[line], &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn(&entry)
+	lines[line], err = json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestLogVerifyIntact(t *testing.T) {
+	archive, key := archivedLog(t)
+
+	// Reopened as after a restart, the log continues after the archived entries and their checkpoints
+	log := newDeviceLog(TEST_LOG_DEVICE, TEST_LOG_CAPACITY, archive, key)
+	if log.length() != TEST_LOG_ENTRIES {
+		t.Fatalf("log continues at %v, expected %v", log.length(), TEST_LOG_ENTRIES)
+	}
+	_, checkpoints := log.entriesAndCheckpoints()
+	if len(checkpoints) != 2 || checkpoints[0].Count != LOG_CHECKPOINT_ENTRIES || checkpoints[1].FirstSeq+checkpoints[1].Count != TEST_LOG_ENTRIES {
+		t.Fatalf("checkpoints %+v", checkpoints)
+	}
+	if !log.verify(nil) {
+		t.Fatal("intact log does not verify")
+	}
+
+	// Entries appended after the restart are chained to the archived ones
+	log.append(LogEntry{ArrivalTime: time.Now(), DevId: TEST_LOG_DEVICE, Outcome: LOG_OUTCOME_DENIED, AuthReq: AuthReq{DevId: TEST_LOG_DEVICE}})
+	if !log.verify(nil) {
+		t.Fatal("log does not verify after appending to it")
+	}
+}
+
+func TestLogVerifyTampered(t *testing.T) {
+	tamperings := []struct {
+		name string
+		edit func(t *testing.T, lines [][]byte) [][]byte
+	}{
+		{"modified", func(t *testing.T, lines [][]byte) [][]byte {
+			return editEntry(t, lines, 10, func(entry *LogEntry) { entry.Granted = !entry.Granted })
+		}},
+		{"modified and rehashed", func(t *testing.T, lines [][]byte) [][]byte {
+			return editEntry(t, lines, 10, func(entry *LogEntry) {
+				entry.Granted = !entry.Granted
+				entry.Hash = entryHash(*entry)
+			})
+		}},
+		{"dropped", func(t *testing.T, lines [][]byte) [][]byte {
+			return append(lines[:10], lines[11:]...)
+		}},
+		{"reordered", func(t *testing.T, lines [][]byte) [][]byte {
+			lines[10], lines[11] = lines[11], lines[10]
+			return lines
+		}},
+		{"dropped from the last checkpoint", func(t *testing.T, lines [][]byte) [][]byte {
+			return append(lines[:TEST_LOG_ENTRIES-2], lines[TEST_LOG_ENTRIES-1])
+		}},
+	}
+
+	for _, tampering := range tamperings {
+		t.Run(tampering.name, func(t *testing.T) {
+			archive, key := archivedLog(t)
+			editSegment(t, archive, func(lines [][]byte) [][]byte {
+				if len(lines) != TEST_LOG_ENTRIES {
+					t.Fatalf("%v archived entries, expected %v", len(lines), TEST_LOG_ENTRIES)
+				}
+				return tampering.edit(t, lines)
+			})
+
+			log := newDeviceLog(TEST_LOG_DEVICE, TEST_LOG_CAPACITY, archive, key)
+			if log.verify(nil) {
+				t.Fatal("tampered log verifies")
+			}
+		})
+	}
+}
+
+func TestLogVerifyForgedCheckpoint(t *testing.T) {
+	archive, key := archivedLog(t)
+
+	// The checkpoints were MACed with another key than the server's
+	otherKey, _ := newLogKey()
+	log := newDeviceLog(TEST_LOG_DEVICE, TEST_LOG_CAPACITY, archive, otherKey)
+	if log.verify(nil) {
+		t.Fatal("checkpoints verify under another key")
+	}
+
+	log = newDeviceLog(TEST_LOG_DEVICE, TEST_LOG_CAPACITY, archive, key)
+	log.chain.checkpoints[0].Root[0] ^= 1
+	if log.verify(nil) {
+		t.Fatal("log verifies against a changed root")
+	}
+}
+
+func TestLogInclusionProof(t *testing.T) {
+	archive, key := archivedLog(t)
+	log := newDeviceLog(TEST_LOG_DEVICE, TEST_LOG_CAPACITY, archive, key)
+	ownerState := &DeviceState{Id: 2, Sesskeys: Sessionkeys{K_s_gw: bytes.Repeat([]byte{2}, 32)}}
+
+	// (1) Every committed entry has a proof against the root of its checkpoint, authenticated to the home owner device
+	entries, checkpoints := log.entriesAndCheckpoints()
+	for _, seq := range []uint64{0, 1, 37, LOG_CHECKPOINT_ENTRIES - 1, LOG_CHECKPOINT_ENTRIES, TEST_LOG_ENTRIES - 1} {
+		proof, err := log.prove(seq, ownerState)
+		if err != nil {
+			t.Fatalf("entry %v: %v", seq, err)
+		}
+		if !bytes.Equal(proof.EntryHash, entryHash(entries[seq])) || !verifyInclusion(proof.EntryHash, proof.LeafIndex, proof.TreeSize, proof.Path, proof.Root) {
+			t.Errorf("entry %v: proof does not verify", seq)
+		}
+
+		checkpoint := checkpoints[0]
+		if seq >= LOG_CHECKPOINT_ENTRIES {
+			checkpoint = checkpoints[1]
+		}
+		mac := hmac.New(sha256.New, ownerState.Sesskeys.K_s_gw)
+		mac.Write(checkpointMacInput(checkpoint))
+		if proof.OwnerId != ownerState.Id || !hmac.Equal(mac.Sum(nil), proof.OwnerMac) {
+			t.Errorf("entry %v: OwnerMac does not authenticate the checkpoint", seq)
+		}
+
+		// A proof holds for its entry and position only
+		if verifyInclusion(entryHash(entries[(seq+1)%TEST_LOG_ENTRIES]), proof.LeafIndex, proof.TreeSize, proof.Path, proof.Root) {
+			t.Errorf("entry %v: proof verifies another entry", seq)
+		}
+		if proof.TreeSize > 1 && verifyInclusion(proof.EntryHash, (proof.LeafIndex+1)%proof.TreeSize, proof.TreeSize, proof.Path, proof.Root) {
+			t.Errorf("entry %v: proof verifies at another index", seq)
+		}
+	}
+
+	// (2) Entries not committed to yet have no proof
+	seq := log.append(LogEntry{ArrivalTime: time.Now(), DevId: TEST_LOG_DEVICE, Outcome: LOG_OUTCOME_DENIED, AuthReq: AuthReq{DevId: TEST_LOG_DEVICE}})
+	if _, err := log.prove(seq, nil); err == nil {
+		t.Error("proof of an entry not committed to")
+	}
+}
+
+// A tampered log never yields a proof
+func TestLogInclusionProofTampered(t *testing.T) {
+	archive, key := archivedLog(t)
+	editSegment(t, archive, func(lines [][]byte) [][]byte {
+		return editEntry(t, lines, 10, func(entry *LogEntry) {
+			entry.Granted = !entry.Granted
+			entry.Hash = entryHash(*entry)
+		})
+	})
+
+	log := newDeviceLog(TEST_LOG_DEVICE, TEST_LOG_CAPACITY, archive, key)
+	if _, err := log.prove(10, nil); err == nil {
+		t.Error("proof of a tampered entry")
+	}
+}
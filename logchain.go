@@ -0,0 +1,381 @@
+// Tamper evidence of the device logs: every entry is chained to its predecessor by hash, and batches of entries are committed to by Merkle roots
+// MACed with the server's log key. The Merkle tree follows RFC 6962, such that a single entry can be proven to be part of a committed batch
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	LOG_KEY_LEN             = 32
+	LOG_CHECKPOINT_ENTRIES  = 64          // Number of sealed entries after which a checkpoint is taken
+	LOG_CHECKPOINT_INTERVAL = time.Minute // Interval in which the sealed entries not yet committed to are checkpointed
+)
+
+// Merkle root over the hashes of the entries firstSeq, ..., firstSeq + Count - 1 of a device's log
+type LogCheckpoint struct {
+	DevId    uint32
+	FirstSeq uint64
+	Count    uint64
+	Root     []byte
+	Time     time.Time
+	Mac      []byte // HMAC-SHA256 under the server's log key, see checkpointMacInput
+}
+
+// Inclusion proof of a log entry in a checkpoint. OwnerMac authenticates the checkpoint to the home owner device, which does not know the log key
+type LogProof struct {
+	DevId      uint32   `json:"devId"`
+	Seq        uint64   `json:"seq"`
+	EntryHash  []byte   `json:"entryHash"`
+	LeafIndex  uint64   `json:"leafIndex"`
+	TreeSize   uint64   `json:"treeSize"`
+	Path       [][]byte `json:"path"`
+	Root       []byte   `json:"root"`
+	FirstSeq   uint64   `json:"firstSeq"`
+	Checkpoint int64    `json:"checkpoint"`         // Unix time of the checkpoint in nanoseconds
+	OwnerId    uint32   `json:"ownerId"`            // Home owner device whose key OwnerMac is created with
+	OwnerMac   []byte   `json:"ownerMac,omitempty"` // HMAC-SHA256 of checkpointMacInput under the home owner device's K_s_gw, nil if there is no home owner device
+}
+
+// Chain state of a log. NOTE: Guarded by the lock of the DeviceLog
+type logChain struct {
+	key         []byte
+	sealed      uint64   // Sequence number of the next entry to seal
+	head        []byte   // Hash of the last sealed entry, nil before the first one
+	leaves      [][]byte // Hashes of the sealed entries not yet committed to by a checkpoint
+	leavesFrom  uint64   // Sequence number of the first of them
+	checkpoints []LogCheckpoint
+}
+
+// Reads the log key from the file, creating a random one if the file does not exist
+func loadLogKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) != LOG_KEY_LEN {
+			return nil, fmt.Errorf("log key %v has %v instead of %v bytes", path, len(key), LOG_KEY_LEN)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err = newLogKey()
+	if err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, key, 0600)
+}
+
+// Creates a random log key
+func newLogKey() ([]byte, error) {
+	key := make([]byte, LOG_KEY_LEN)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// Hash of the entry, over its JSON encoding without the hash itself. NOTE: The encoding is stable across spilling, such that spilled entries can be verified
+func entryHash(entry LogEntry) []byte {
+	entry.Hash = nil
+	encoded, err := json.Marshal(entry)
+	checkSuccessString("logchain, encoding entry", err)
+	hash := sha256.Sum256(encoded)
+	return hash[:]
+}
+
+// Chains the entries in order, as long as their outcome is known or their sequence number is below force. Entries are not changed once sealed.
+// The caller must hold the lock
+func (l *DeviceLog) seal(force uint64) {
+	c := l.chain
+	for c.sealed < l.next {
+		entry := &l.buf[c.sealed%uint64(cap(l.buf))]
+		if entry.Outcome == LOG_OUTCOME_PENDING && c.sealed >= force {
+			// Case: The entry may still change, e.g. a request parked for the home owner device ==> Later entries wait for it
+			return
+		}
+
+		entry.PrevHash = c.head
+		entry.Hash = entryHash(*entry)
+		c.head = entry.Hash
+		c.leaves = append(c.leaves, entry.Hash)
+		c.sealed += 1
+
+		if len(c.leaves) >= LOG_CHECKPOINT_ENTRIES {
+			l.checkpointLocked()
+		}
+	}
+}
+
+// Commits to the sealed entries since the last checkpoint. The caller must hold the lock
+func (l *DeviceLog) checkpointLocked() {
+	c := l.chain
+	if len(c.leaves) == 0 {
+		return
+	}
+
+	checkpoint := LogCheckpoint{DevId: l.devId, FirstSeq: c.leavesFrom, Count: uint64(len(c.leaves)), Root: merkleRoot(c.leaves), Time: time.Now()}
+	checkpoint.Mac = checkpointMac(c.key, checkpoint)
+
+	l.archive.putCheckpoint(checkpoint)
+	c.checkpoints = append(c.checkpoints, checkpoint)
+	c.leavesFrom += uint64(len(c.leaves))
+	c.leaves = nil
+}
+
+// Commits to the sealed entries since the last checkpoint
+func (l *DeviceLog) checkpoint() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.checkpointLocked()
+}
+
+// Checkpoints the logs of every device periodically, such that entries of quiet devices are committed to as well
+func checkpointLogs(devices *DeviceRegistry) {
+	for range time.Tick(LOG_CHECKPOINT_INTERVAL) {
+		devices.forEach(func(devState *DeviceState) bool {
+			devState.Log.checkpoint()
+			return true
+		})
+	}
+}
+
+// |  "LOGROOT"  |  dev_id  |  first_seq  |  count  |  root  |  time (unix nanoseconds)  |
+func checkpointMacInput(checkpoint LogCheckpoint) []byte {
+	input := append([]byte("LOGROOT"), make([]byte, DEVICE_ID_LEN+8+8)...)
+	binary.LittleEndian.PutUint32(input[7:], checkpoint.DevId)
+	binary.LittleEndian.PutUint64(input[7+DEVICE_ID_LEN:], checkpoint.FirstSeq)
+	binary.LittleEndian.PutUint64(input[7+DEVICE_ID_LEN+8:], checkpoint.Count)
+	input = append(input, checkpoint.Root...)
+
+	var t [8]byte
+	binary.LittleEndian.PutUint64(t[:], uint64(checkpoint.Time.UnixNano()))
+	return append(input, t[:]...)
+}
+
+func checkpointMac(key []byte, checkpoint LogCheckpoint) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(checkpointMacInput(checkpoint))
+	return mac.Sum(nil)
+}
+
+// - - - - - - - - - - - - - - - - - - Merkle tree (RFC 6962) - - - - - - - - - - - - - - - - - -
+
+func merkleLeaf(entryHash []byte) []byte {
+	hash := sha256.Sum256(append([]byte{0x00}, entryHash...))
+	return hash[:]
+}
+
+func merkleNode(left []byte, right []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{0x01}, left...), right...))
+	return hash[:]
+}
+
+// Largest power of two smaller than n, n > 1
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// Root over the entry hashes
+func merkleRoot(entryHashes [][]byte) []byte {
+	switch len(entryHashes) {
+	case 0:
+		hash := sha256.Sum256(nil)
+		return hash[:]
+	case 1:
+		return merkleLeaf(entryHashes[0])
+	}
+	k := merkleSplit(len(entryHashes))
+	return merkleNode(merkleRoot(entryHashes[:k]), merkleRoot(entryHashes[k:]))
+}
+
+// Audit path of the m-th entry hash, from the leaf up
+func merklePath(m int, entryHashes [][]byte) [][]byte {
+	if len(entryHashes) <= 1 {
+		return nil
+	}
+	k := merkleSplit(len(entryHashes))
+	if m < k {
+		return append(merklePath(m, entryHashes[:k]), merkleRoot(entryHashes[k:]))
+	}
+	return append(merklePath(m-k, entryHashes[k:]), merkleRoot(entryHashes[:k]))
+}
+
+// Checks the audit path of the entry hash at the index of a tree of the size against the root, see RFC 9162 section 2.1.3.2
+func verifyInclusion(entryHash []byte, index uint64, size uint64, path [][]byte, root []byte) bool {
+	if index >= size {
+		return false
+	}
+
+	fn, sn := index, size-1
+	r := merkleLeaf(entryHash)
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn%2 == 1 || fn == sn {
+			r = merkleNode(p, r)
+			for fn%2 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNode(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// - - - - - - - - - - - - - - - - - - Verification and proofs - - - - - - - - - - - - - - - - - -
+
+// Returns the device's entries which are still available, in memory or in the archive, and its checkpoints
+func (l *DeviceLog) entriesAndCheckpoints() ([]LogEntry, []LogCheckpoint) {
+	entries := l.page(0, int(l.length()))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return entries, append([]LogCheckpoint(nil), l.chain.checkpoints...)
+}
+
+// Checks the hash chain and the checkpoints of the log. Breaks are printed to the console and recorded in the audit trail, returns false if there is any
+func (l *DeviceLog) verify(audit *Auditor) bool {
+	entries, checkpoints := l.entriesAndCheckpoints()
+	intact := true
+	broken := func(details string) {
+		fmt.Println("CONSOLE, Warning: Log of device", l.devId, details)
+		audit.record(AUDIT_LOG_TAMPERED, auditDevice(l.devId), AuditSource{}, details)
+		intact = false
+	}
+
+	// (1) Check that every sealed entry hashes to its hash and refers to its predecessor's
+	hashes := make(map[uint64][]byte)
+	var sealed, pending int
+	var prev *LogEntry
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Hash == nil {
+			// Case: Not sealed yet, e.g. a parked request. NOTE: Sealing is in order, every later entry is unsealed as well
+			pending += 1
+			continue
+		}
+		sealed += 1
+
+		if !bytes.Equal(entryHash(*entry), entry.Hash) {
+			broken(fmt.Sprint("entry ", entry.Seq, " does not match its hash"))
+		}
+		if prev != nil && prev.Seq+1 == entry.Seq && !bytes.Equal(prev.Hash, entry.PrevHash) {
+			broken(fmt.Sprint("entry ", entry.Seq, " does not refer to the hash of entry ", prev.Seq))
+		}
+		if prev == nil && entry.Seq == 0 && entry.PrevHash != nil {
+			broken("entry 0 refers to a predecessor")
+		}
+		if prev != nil && prev.Seq+1 != entry.Seq {
+			// Case: Retention only deletes the oldest segments as a whole ==> Entries missing in between were deleted otherwise
+			broken(fmt.Sprint("entries ", prev.Seq+1, " to ", entry.Seq-1, " are missing"))
+		}
+
+		hashes[entry.Seq] = entry.Hash
+		prev = entry
+	}
+	first := l.length()
+	if len(entries) > 0 {
+		first = entries[0].Seq
+	}
+	if first > 0 {
+		fmt.Println("CONSOLE: Entries before", first, "of device", l.devId, "were deleted by retention ==> Chain checked from there")
+	}
+
+	// (2) Check the MAC of every checkpoint and, unless retention deleted all of its entries, its root
+	var rootsChecked int
+	for _, checkpoint := range checkpoints {
+		if !hmac.Equal(checkpointMac(l.chain.key, checkpoint), checkpoint.Mac) {
+			broken(fmt.Sprint("checkpoint of entries ", checkpoint.FirstSeq, " to ", checkpoint.FirstSeq+checkpoint.Count-1, " has a bad MAC"))
+			continue
+		}
+
+		leaves := make([][]byte, 0, checkpoint.Count)
+		for seq := checkpoint.FirstSeq; seq < checkpoint.FirstSeq+checkpoint.Count; seq++ {
+			if hash, exists := hashes[seq]; exists {
+				leaves = append(leaves, hash)
+			}
+		}
+		if len(leaves) == 0 && checkpoint.FirstSeq+checkpoint.Count <= first {
+			// Case: Before the oldest entry still available
+			continue
+		}
+		if uint64(len(leaves)) != checkpoint.Count {
+			broken(fmt.Sprint(checkpoint.Count-uint64(len(leaves)), " of the entries ", checkpoint.FirstSeq, " to ", checkpoint.FirstSeq+checkpoint.Count-1, " committed to by a checkpoint are missing"))
+			continue
+		}
+
+		rootsChecked += 1
+		if !bytes.Equal(merkleRoot(leaves), checkpoint.Root) {
+			broken(fmt.Sprint("entries ", checkpoint.FirstSeq, " to ", checkpoint.FirstSeq+checkpoint.Count-1, " do not match their checkpoint's root"))
+		}
+	}
+
+	fmt.Printf("CONSOLE: Log of device %v: %v entries sealed, %v pending, %v of %v checkpoints checked against their entries ==> Intact: %v\n", l.devId, sealed, pending, rootsChecked, len(checkpoints), intact)
+	return intact
+}
+
+// Creates the inclusion proof of the entry in its checkpoint. ownerState may be nil, in which case the proof carries no OwnerMac
+func (l *DeviceLog) prove(seq uint64, ownerState *DeviceState) (LogProof, error) {
+	entries, checkpoints := l.entriesAndCheckpoints()
+
+	// (1) Find the checkpoint committing to the entry
+	var checkpoint *LogCheckpoint
+	for i := range checkpoints {
+		if checkpoints[i].FirstSeq <= seq && seq < checkpoints[i].FirstSeq+checkpoints[i].Count {
+			checkpoint = &checkpoints[i]
+		}
+	}
+	if checkpoint == nil {
+		return LogProof{}, fmt.Errorf("entry %v of device %v is not committed to by a checkpoint yet", seq, l.devId)
+	}
+
+	// (2) Gather the hashes of the checkpoint's entries
+	leaves := make([][]byte, 0, checkpoint.Count)
+	for _, entry := range entries {
+		if entry.Seq >= checkpoint.FirstSeq && entry.Seq < checkpoint.FirstSeq+checkpoint.Count && entry.Hash != nil {
+			leaves = append(leaves, entry.Hash)
+		}
+	}
+	if uint64(len(leaves)) != checkpoint.Count {
+		return LogProof{}, fmt.Errorf("entries of the checkpoint of entry %v of device %v were deleted by retention", seq, l.devId)
+	}
+
+	// (3) Create the audit path and check it, such that a tampered log never yields a proof
+	index := seq - checkpoint.FirstSeq
+	proof := LogProof{DevId: l.devId, Seq: seq, EntryHash: leaves[index], LeafIndex: index, TreeSize: checkpoint.Count, Path: merklePath(int(index), leaves),
+		Root: checkpoint.Root, FirstSeq: checkpoint.FirstSeq, Checkpoint: checkpoint.Time.UnixNano()}
+	if !verifyInclusion(proof.EntryHash, proof.LeafIndex, proof.TreeSize, proof.Path, proof.Root) {
+		return LogProof{}, fmt.Errorf("entries of the checkpoint of entry %v of device %v do not match its root", seq, l.devId)
+	}
+
+	if ownerState != nil {
+		mac := hmac.New(sha256.New, ownerState.Sesskeys.K_s_gw)
+		mac.Write(checkpointMacInput(*checkpoint))
+		proof.OwnerId, proof.OwnerMac = ownerState.Id, mac.Sum(nil)
+	}
+
+	return proof, nil
+}
@@ -4,20 +4,151 @@ package main
 //       https://stackoverflow.com/questions/65748509/vscode-show-me-the-error-after-i-install-the-proxy-in-vscode
 
 import (
+	"crypto/ed25519"
+	"flag"
 	"fmt"
 	"net"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"time"
 )
 
 func main() {
+	// Parse command line flags
+	policyPath := flag.String("policy", "", "Path to the access-control policy file (JSON). If empty, every authentic request is granted")
+	enforceCaps := flag.Bool("capabilities", false, "Only grant the access types declared in the capability document behind each device's CapURI")
+	capRefresh := flag.Duration("cap-refresh", 10*time.Minute, "Age after which a cached capability document is fetched again")
+	manufacturerKeysPath := flag.String("manufacturer-keys", "", "Path to the trusted manufacturer keys per device type (JSON). If set, capability documents must be signed")
+	capFallback := flag.String("cap-fallback", "", "Comma separated access types granted to devices whose capability document fails verification")
+	actuatorApproval := flag.Bool("actuator-approval", false, "Park granted write (e.g. actuator) requests until the home owner device approves or denies them")
+	approvalTimeout := flag.Duration("approval-timeout", 30*time.Second, "Time the home owner device has to decide on a parked actuator request")
+	approvalDefault := flag.String("approval-default", "deny", "Decision (allow or deny) applied to parked actuator requests on timeout or if no home owner device exists")
+	rateLimitsPath := flag.String("rate-limits", "", "Path to the per-device token bucket and daily quota configuration (JSON). If empty, requests are not rate limited")
+	leasesPath := flag.String("leases", "", "Path to the exclusive actuator lease definitions (JSON). If empty, no leases are required")
+	anomaliesPath := flag.String("anomalies", "", "Path to the anomaly detection thresholds (JSON). If empty, anomalies are not detected")
+	stateDir := flag.String("state-dir", "", "Directory of the device registry's journal and snapshots. If empty, devices are forgotten on restart")
+	snapshotEvery := flag.Int("snapshot-every", 1000, "Number of journal records after which a snapshot of the device registry is taken")
+	authShards := flag.Int("shards", runtime.NumCPU(), "Number of goroutines checking authentication requests in parallel, sharded by device ID")
+	handshakeWorkers := flag.Int("handshake-workers", runtime.NumCPU(), "Number of goroutines performing the handshakes of signups")
+	handshakeQueue := flag.Int("handshake-queue", 100, "Number of signups which may await a handshake worker. Further signups are rejected until the queue drains")
+	scanTTL := flag.Duration("scan-ttl", 0, "Time after which a scan entered on the console without a TTL expires unless a signup used it. If 0, it never expires")
+	signupHold := flag.Duration("signup-hold", time.Minute, "Time a signup which arrived before the scan of its key waits for the scan before the gateway is told it is not provisioned. If 0, it is told right away")
+	logBuffer := flag.Int("log-buffer", 256, "Number of log entries kept in memory per device")
+	logDir := flag.String("log-dir", "", "Directory older log entries are spilled to as JSONL segment files per device. If empty, they are dropped")
+	logSegmentSize := flag.Int64("log-segment-size", 1<<20, "Size in bytes after which a new log segment file is started")
+	logMaxAge := flag.Duration("log-max-age", 0, "Age after which log segment files are deleted. If 0, they are kept regardless of age")
+	logMaxBytes := flag.Int64("log-max-bytes", 0, "Size in bytes of the log segment files kept per device, the oldest are deleted beyond. If 0, they are kept regardless of size")
+	auditPath := flag.String("audit-file", "", "Path of the file security events are appended to as JSON lines. If empty, they are only kept for the console")
+	randomIds := flag.Bool("random-ids", false, "Hand out random 32-bit device IDs instead of sequential ones, such that the IDs do not reveal the number of devices")
+	idQuarantine := flag.Duration("id-quarantine", 30*24*time.Hour, "Time after which the ID of a deleted device may be handed out again")
+	deviceTypesPath := flag.String("device-types", "", "Path to the device-type registry (JSON). If set, signups of unknown device types are rejected")
+	flag.Parse()
+
+	cfg := &Config{ActuatorApproval: *actuatorApproval, ApprovalTimeout: *approvalTimeout, Delegations: newDelegationStore(), AuthShards: *authShards, HandshakeWorkers: *handshakeWorkers, HandshakeQueue: *handshakeQueue, LogBuffer: *logBuffer, ScanTTL: *scanTTL, HeldSignups: newSignupHold(*signupHold), RandomDevIds: *randomIds, IdQuarantine: *idQuarantine}
+
+	switch *approvalDefault {
+	case "allow":
+		cfg.ApprovalDefault = DECISION_ALLOW
+	case "deny":
+		cfg.ApprovalDefault = DECISION_DENY
+	default:
+		checkErrorKill(fmt.Errorf("invalid -approval-default \"%s\", expected allow or deny", *approvalDefault))
+	}
+
+	if *deviceTypesPath != "" {
+		deviceTypes, err := loadDeviceTypes(*deviceTypesPath)
+		checkErrorKill(err)
+		cfg.DeviceTypes = deviceTypes
+		fmt.Println("INFO: Loaded", len(deviceTypes.types), "device types from", *deviceTypesPath)
+	}
+
+	if *policyPath != "" {
+		policy, err := loadPolicy(*policyPath)
+		checkErrorKill(err)
+		cfg.Policy = policy
+		fmt.Println("INFO: Loaded policy from", *policyPath, "with", len(policy.Rules), "rules")
+	}
+
+	if *rateLimitsPath != "" {
+		rateLimiter, err := loadRateLimits(*rateLimitsPath)
+		checkErrorKill(err)
+		cfg.RateLimiter = rateLimiter
+		fmt.Println("INFO: Loaded rate limits from", *rateLimitsPath)
+	}
+
+	if *leasesPath != "" {
+		leases, err := loadLeases(*leasesPath)
+		checkErrorKill(err)
+		cfg.Leases = leases
+		fmt.Println("INFO: Loaded lease definitions from", *leasesPath)
+	}
+
+	if *anomaliesPath != "" {
+		anomalies, err := loadAnomalyConfig(*anomaliesPath)
+		checkErrorKill(err)
+		cfg.Anomalies = anomalies
+		fmt.Println("INFO: Loaded anomaly detection thresholds from", *anomaliesPath)
+	}
+
+	if *stateDir != "" {
+		store, err := openStore(*stateDir, *snapshotEvery)
+		checkErrorKill(err)
+		cfg.Store = store
+	}
+
+	if *logDir != "" {
+		archive, err := openLogArchive(*logDir, *logSegmentSize, *logMaxAge, *logMaxBytes)
+		checkErrorKill(err)
+		cfg.LogArchive = archive
+	}
+
+	cfg.Audit = newAuditor(nil)
+	if *auditPath != "" {
+		auditSink, err := openFileAuditSink(*auditPath)
+		checkErrorKill(err)
+		cfg.Audit = newAuditor(auditSink.lastHash(), auditSink)
+		fmt.Println("INFO: Appending security events to", *auditPath)
+	}
+
+	// Key MACing the checkpoints of the logs. Kept next to the segments, such that the checkpoints can be verified after a restart
+	if *logDir != "" {
+		logKey, err := loadLogKey(filepath.Join(*logDir, "log.key"))
+		checkErrorKill(err)
+		cfg.LogKey = logKey
+	} else {
+		logKey, err := newLogKey()
+		checkErrorKill(err)
+		cfg.LogKey = logKey
+	}
+
+	if *enforceCaps {
+		var manufacturerKeys map[uint16][]ed25519.PublicKey
+		if *manufacturerKeysPath != "" {
+			var err error
+			manufacturerKeys, err = loadManufacturerKeys(*manufacturerKeysPath)
+			checkErrorKill(err)
+			fmt.Println("INFO: Loaded manufacturer keys for", len(manufacturerKeys), "device types from", *manufacturerKeysPath)
+		}
+
+		fallback, err := parseAccessTypeList(*capFallback)
+		checkErrorKill(err)
+
+		cfg.Capabilities = newCapabilityCache(*capRefresh, &http.Client{Timeout: 10 * time.Second}, manufacturerKeys, fallback)
+	} else if *manufacturerKeysPath != "" {
+		fmt.Println("WARNING: -manufacturer-keys has no effect without -capabilities")
+	}
+
 	// Set up channels to be used
 	var (
 		authReqChan chan AuthReq   = make(chan AuthReq, 1000)
 		signupChan  chan SignupReq = make(chan SignupReq, 1000)
 		scanChan    chan Scan      = make(chan Scan, 1000)
+
+		ownerDecisionChan chan OwnerDecision = make(chan OwnerDecision, 1000) // Acks and denies of the home owner device. Alerts are written to its connection directly
+		delegationChan    chan DelegationReq = make(chan DelegationReq, 1000) // Delegations issued and revoked by the home owner device
 	// sd_channel     chan Sd_Msg     = make(chan Sd_Msg, 1000)
 	// dd_channel     chan Dd_Msg     = make(chan Dd_Msg, 1000)
-	// alert_channel  chan Alert_Msg  = make(chan Alert_Msg, 1000)
-	// ack_channel    chan Ack_Msg    = make(chan Ack_Msg, 1000)
 	)
 
 	service := ":1200"
@@ -29,21 +160,23 @@ func main() {
 	listener, err := net.ListenTCP(tcpaddr.Network(), tcpaddr)
 	checkErrorKill(err)
 
-	// Fork processor task
-	go processor(signupChan, authReqChan, scanChan)
-
-	// Fork scan task which simulates scanning the code of a device
+	// Fork the task accepting connections
+	go func() {
+		var i uint32 = 0
 
-	var i uint32 = 0
+		for {
+			c, err := listener.AcceptTCP()
+			if !checkSuccessString("main.go, listener", err) {
+				continue
+			}
+			go connHandler(c, i, signupChan, authReqChan, ownerDecisionChan, delegationChan, cfg.Audit)
+			fmt.Println("INFO: New TCP connection from", c.RemoteAddr().String())
 
-	for {
-		c, err := listener.AcceptTCP()
-		if !checkSuccessString("main.go, listener", err) {
-			continue
+			i += 1
 		}
-		go connHandler(c, i, signupChan, authReqChan)
-		fmt.Println("INFO: New TCP connection from", c.RemoteAddr().String())
+	}()
 
-		i += 1
-	}
+	// Run the processor until the server is interrupted or terminated
+	processor(cfg, signupChan, authReqChan, scanChan, ownerDecisionChan, delegationChan)
+	fmt.Println("INFO: Shut down")
 }
@@ -0,0 +1,263 @@
+// Messages exchanged with the home owner device, which approves what the server does not decide on its own
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// Returns true if the counters are strictly newer than the ones stored for the device.
+// Owner decisions carry no server randomness, so unlike authentication requests they must never reuse the current counters
+func countersFresh(devState *DeviceState, rebCnt uint32, reqCnt uint32) bool {
+	if rebCnt != devState.rebCnt {
+		return rebCnt > devState.rebCnt
+	}
+	return reqCnt > devState.reqCnt
+}
+
+func createOwnerAlert(kind uint8, ticket uint32, devId uint32, detail uint16, authKey []byte) ([]byte, error) {
+
+	// (1) Allocate message buffer
+	msgBuf := make([]byte, HEADER_LEN+LEN_PAYLOAD_OWNER_ALERT)
+
+	// (2) Build header
+	buildHeader(msgBuf[0:HEADER_LEN], PAYLOAD_OWNER_ALERT)
+
+	// (3) Populate payload with: |  kind  |  ticket  |  dev_id  |  detail  |  HMAC(K_s_gw, kind || ticket || dev_id || detail)  |
+	payloadBuf := msgBuf[HEADER_LEN:]
+
+	payloadBuf[0] = kind
+	binary.LittleEndian.PutUint32(payloadBuf[OWNER_KIND_LEN:], ticket)
+	binary.LittleEndian.PutUint32(payloadBuf[OWNER_KIND_LEN+TICKET_LEN:], devId)
+	binary.LittleEndian.PutUint16(payloadBuf[OWNER_KIND_LEN+TICKET_LEN+DEVICE_ID_LEN:], detail)
+
+	macOffset := OWNER_KIND_LEN + TICKET_LEN + DEVICE_ID_LEN + ACCESS_TYPE_LEN
+
+	hmacer := hmac.New(sha256.New, authKey)
+	_, err := hmacer.Write(payloadBuf[:macOffset])
+	if err != nil {
+		return nil, err
+	}
+	copy(payloadBuf[macOffset:], hmacer.Sum(nil))
+
+	return msgBuf, nil
+}
+
+// Sends an owner alert to the home owner device
+func sendOwnerAlert(ownerState *DeviceState, kind uint8, ticket uint32, devId uint32, detail uint16) {
+	if ownerState.Conn == nil {
+		// Case: Restored from the store, and the home owner device has not sent an authentication request since
+		fmt.Println("WARNING, owner: Home owner device", ownerState.Id, "has no connection yet ==> Alert of kind", kind, "for device", devId, "dropped")
+		return
+	}
+
+	alertMsg, err := createOwnerAlert(kind, ticket, devId, detail, ownerState.Sesskeys.K_s_gw)
+	if !checkSuccessString("owner, creating owner alert", err) {
+		return
+	}
+
+	_, err = ownerState.Conn.Write(alertMsg)
+	if !checkSuccessString("owner, sending owner alert", err) {
+		return
+	}
+
+	fmt.Println("DEBUG, owner: Sent alert of kind", kind, "with ticket", ticket, "for device", devId, "to home owner device", ownerState.Id)
+}
+
+// Checks freshness and authenticity of a decision claimed to be sent by the device described by devState
+func verifyOwnerDecision(audit *Auditor, devState *DeviceState, decision OwnerDecision) bool {
+
+	// Body to MAC over after the counters: |  kind  |  ticket  |  decision  |
+	body := make([]byte, OWNER_KIND_LEN+TICKET_LEN+DECISION_LEN)
+	body[0] = decision.Kind
+	binary.LittleEndian.PutUint32(body[OWNER_KIND_LEN:], decision.Ticket)
+	body[OWNER_KIND_LEN+TICKET_LEN] = decision.Decision
+
+	return verifyOwnerMessage(audit, decision.Source, devState, "decision", decision.RebCnt, decision.ReqCnt, body, decision.MacTag)
+}
+
+// Checks freshness and authenticity of a delegation request claimed to be sent by the device described by devState
+func verifyDelegationReq(audit *Auditor, devState *DeviceState, req DelegationReq) bool {
+
+	// Body to MAC over after the counters: |  op  |  grantee  |  grantor  |  access_type  |  expires  |
+	body := make([]byte, DELEGATION_OP_LEN+DEVICE_ID_LEN+DEVICE_ID_LEN+ACCESS_TYPE_LEN+EXPIRES_LEN)
+	body[0] = req.Op
+	binary.LittleEndian.PutUint32(body[DELEGATION_OP_LEN:], req.Grantee)
+	binary.LittleEndian.PutUint32(body[DELEGATION_OP_LEN+DEVICE_ID_LEN:], req.Grantor)
+	binary.LittleEndian.PutUint16(body[DELEGATION_OP_LEN+DEVICE_ID_LEN+DEVICE_ID_LEN:], req.AccessType)
+	binary.LittleEndian.PutUint64(body[DELEGATION_OP_LEN+DEVICE_ID_LEN+DEVICE_ID_LEN+ACCESS_TYPE_LEN:], req.Expires)
+
+	return verifyOwnerMessage(audit, req.Source, devState, "delegation", req.RebCnt, req.ReqCnt, body, req.MacTag)
+}
+
+// Checks the counters and the MAC tag over |  reb_cnt  |  req_cnt  |  body  | of a message of the home owner device. Failures are audited
+func verifyOwnerMessage(audit *Auditor, source AuditSource, devState *DeviceState, what string, rebCnt uint32, reqCnt uint32, body []byte, macTag []byte) bool {
+
+	// (1) Check freshness
+	if !countersFresh(devState, rebCnt, reqCnt) {
+		fmt.Println("WARNING, owner: Owner", what, "has old counters")
+		audit.record(AUDIT_STALE_COUNTER, auditDevice(devState.Id), source, fmt.Sprintf("owner %v with counters %v/%v", what, rebCnt, reqCnt))
+		return false
+	}
+
+	// (2) Create slice to MAC over
+	macInput := make([]byte, REB_CNT_LEN+REQ_CNT_LEN+len(body))
+	binary.LittleEndian.PutUint32(macInput, rebCnt)
+	binary.LittleEndian.PutUint32(macInput[REB_CNT_LEN:], reqCnt)
+	copy(macInput[REB_CNT_LEN+REQ_CNT_LEN:], body)
+
+	// (3) Compare with included tag
+	hmacer := hmac.New(sha256.New, devState.Sesskeys.K_gw_s)
+	_, err := hmacer.Write(macInput)
+	if !checkSuccessString("owner, digesting owner "+what, err) {
+		return false
+	}
+
+	if subtle.ConstantTimeCompare(hmacer.Sum(nil), macTag) != 1 {
+		fmt.Println("WARNING, owner: Owner", what, "has bad MAC Tag")
+		audit.record(AUDIT_BAD_MAC, auditDevice(devState.Id), source, "owner "+what)
+		return false
+	}
+
+	return true
+}
+
+// Makes devId the home owner device, replacing any previous one, and alerts it of every device still awaiting approval
+func designateOwner(store *Store, devices *DeviceRegistry, devId uint32) bool {
+
+	// (1) Check that the device exists. Suspended and revoked devices cannot take the role
+	devState, exists := devices.get(devId)
+	if !exists {
+		fmt.Println("WARNING, owner: Cannot designate unknown device", devId, "as home owner device")
+		return false
+	}
+	if devState.Status != DEVICE_ACTIVE {
+		fmt.Println("WARNING, owner: Cannot designate", DEVICE_STATUS_NAMES[devState.Status], "device", devId, "as home owner device")
+		return false
+	}
+
+	// (2) Strip the previous owner of its role
+	var previous []uint32
+	devices.forEach(func(devState *DeviceState) bool {
+		if devState.Owner && devState.Id != devId {
+			previous = append(previous, devState.Id)
+		}
+		return true
+	})
+	for _, id := range previous {
+		if !devices.commit(store, id, func(devState *DeviceState) { devState.Owner = false }) {
+			return false
+		}
+	}
+
+	// (3) The owner approves itself
+	if !devices.commit(store, devId, func(ownerState *DeviceState) {
+		ownerState.Owner = true
+		ownerState.Pending = false
+	}) {
+		return false
+	}
+
+	fmt.Println("INFO, owner: Device", devId, "is now the home owner device")
+
+	// (4) Ask the new owner about every device awaiting approval
+	ownerState, _ := devices.get(devId)
+
+	var pending []DeviceState
+	devices.forEach(func(devState *DeviceState) bool {
+		if devState.Pending {
+			pending = append(pending, DeviceState{Id: devState.Id, Type: devState.Type})
+		}
+		return true
+	})
+	for _, devState := range pending {
+		sendOwnerAlert(&ownerState, OWNER_KIND_SIGNUP, devState.Id, devState.Id, devState.Type)
+	}
+
+	return true
+}
+
+// Which device is the home owner device, shared by the processor and the shards
+type HomeOwner struct {
+	mu      sync.Mutex
+	id      uint32
+	has     bool // If neither has nor retired is set, the first device to pair becomes the home owner device
+	retired bool // Set once a home owner device existed and lost its role. The next one is designated on the console only
+}
+
+// Returns the ID of the home owner device, the flag is unset if none exists
+func (h *HomeOwner) get() (uint32, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.id, h.has
+}
+
+// Returns true if devId is the home owner device
+func (h *HomeOwner) is(devId uint32) bool {
+	ownerId, hasOwner := h.get()
+	return hasOwner && ownerId == devId
+}
+
+// Records devId as the home owner device without designating it, e.g. after restoring the store
+func (h *HomeOwner) set(devId uint32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.id, h.has = devId, true
+}
+
+// Forgets devId as the home owner device, e.g. once it is revoked. Nothing happens if devId is not the home owner device.
+// NOTE: Pairing does not designate a home owner device afterwards, otherwise any device pairing next, e.g. one awaiting approval, would
+// approve itself and gain the role
+func (h *HomeOwner) clear(devId uint32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.has && h.id == devId {
+		h.has, h.retired = false, true
+		fmt.Println("INFO, owner: Device", devId, "is no longer the home owner device ==> Designate the next one on the console")
+	}
+}
+
+// Records that a home owner device existed before, e.g. after restoring the store, such that pairing does not designate one
+func (h *HomeOwner) retire() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.retired = true
+}
+
+// Designates devId as the home owner device. If onlyFirst is set, nothing happens if a home owner device exists or existed already.
+// NOTE: The lock is held while designating, such that two devices pairing at once cannot both become the home owner device
+func (h *HomeOwner) designate(store *Store, devices *DeviceRegistry, devId uint32, onlyFirst bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if onlyFirst && (h.has || h.retired) {
+		return false
+	}
+	if !designateOwner(store, devices, devId) {
+		return false
+	}
+
+	h.id, h.has = devId, true
+	return true
+}
+
+// Returns the state of the home owner device, or nil if none exists
+func (h *HomeOwner) state(devices *DeviceRegistry) *DeviceState {
+	ownerId, hasOwner := h.get()
+	if !hasOwner {
+		return nil
+	}
+	ownerState, exists := devices.get(ownerId)
+	if !exists {
+		return nil
+	}
+	return &ownerState
+}
@@ -0,0 +1,168 @@
+// Access-control policy engine, consulted by the processor once an authentication request is known to be fresh and authentic
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Selects the requests a rule applies to. Empty lists match everything, i.e. a rule without devIds applies to all devices
+type PolicyMatch struct {
+	DevIds      []uint32 `json:"devIds"`
+	DevTypes    []uint16 `json:"devTypes"`
+	AccessTypes []string `json:"accessTypes"`
+
+	accessTypes []uint16 // Access type names resolved to their numerical values
+}
+
+// A single rule of the policy
+type PolicyRule struct {
+	PolicyMatch
+	Decision string `json:"decision"` // Either "allow" or "deny"
+
+	allow bool
+}
+
+// Policy file layout:
+//
+//	{
+//	  "default": "deny",
+//	  "rules": [
+//	    { "devTypes": [1], "accessTypes": ["SAMPLE_SENSOR_0", "SAMPLE_SENSOR_1"], "decision": "allow" },
+//	    { "devIds": [3], "accessTypes": ["CONTROL_ACTUATOR_1"], "decision": "allow" }
+//	  ],
+//	  "schedules": [ ... ],
+//	  "interlocks": [ ... ],
+//	  "holidays": ["2026-12-25"]
+//	}
+//
+// Rules are evaluated in order, the first matching rule decides. If no rule matches, the default decides.
+// Requests granted by the rules must in addition pass every matching schedule, see schedule.go, and interlock, see interlock.go
+type PolicyEngine struct {
+	Default    string          `json:"default"`
+	Rules      []PolicyRule    `json:"rules"`
+	Schedules  []ScheduleRule  `json:"schedules"`
+	Interlocks []InterlockRule `json:"interlocks"`
+	Holidays   []string        `json:"holidays"` // Dates (YYYY-MM-DD) on which no schedule window is active
+
+	defaultAllow bool
+	holidays     map[string]bool
+}
+
+func loadPolicy(path string) (*PolicyEngine, error) {
+
+	// (1) Read and parse the policy file
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &PolicyEngine{}
+	err = json.Unmarshal(raw, policy)
+	if err != nil {
+		return nil, &InvalidPolicy{Path: path, Reason: err.Error()}
+	}
+
+	// (2) Resolve the decisions and access type names
+	policy.defaultAllow, err = parseDecision(path, policy.Default)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+
+		rule.allow, err = parseDecision(path, rule.Decision)
+		if err != nil {
+			return nil, err
+		}
+
+		err = rule.resolve(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// (3) Resolve the schedules
+	policy.holidays, err = parseDates(path, policy.Holidays)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range policy.Schedules {
+		err = policy.Schedules[i].resolve(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// (4) Resolve the interlocks
+	for i := range policy.Interlocks {
+		err = policy.Interlocks[i].resolve(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return policy, nil
+}
+
+// Resolves the access type names
+func (m *PolicyMatch) resolve(path string) error {
+	m.accessTypes = make([]uint16, len(m.AccessTypes))
+	for i, name := range m.AccessTypes {
+		accessType, exists := ACCESS_TYPE_NAMES[name]
+		if !exists {
+			return &InvalidPolicy{Path: path, Reason: "unknown access type \"" + name + "\""}
+		}
+		m.accessTypes[i] = accessType
+	}
+	return nil
+}
+
+func parseDecision(path string, decision string) (bool, error) {
+	switch decision {
+	case "allow":
+		return true, nil
+	case "deny":
+		return false, nil
+	default:
+		return false, &InvalidPolicy{Path: path, Reason: "unknown decision \"" + decision + "\""}
+	}
+}
+
+func (m *PolicyMatch) matches(devState *DeviceState, accessType uint16) bool {
+	if len(m.DevIds) > 0 && !containsUint32(m.DevIds, devState.Id) {
+		return false
+	}
+	if len(m.DevTypes) > 0 && !containsUint16(m.DevTypes, devState.Type) {
+		return false
+	}
+	if len(m.accessTypes) > 0 && !containsUint16(m.accessTypes, accessType) {
+		return false
+	}
+	return true
+}
+
+// Returns the decision and reason code for an authentic request of the given device. A nil policy grants everything
+func (p *PolicyEngine) decide(devState *DeviceState, accessType uint16) (uint8, uint8) {
+	if p == nil {
+		return DECISION_ALLOW, REASON_NONE
+	}
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.matches(devState, accessType) {
+			continue
+		}
+		if rule.allow {
+			return DECISION_ALLOW, REASON_POLICY_RULE
+		}
+		return DECISION_DENY, REASON_POLICY_RULE
+	}
+
+	if p.defaultAllow {
+		return DECISION_ALLOW, REASON_POLICY_DEFAULT
+	}
+	return DECISION_DENY, REASON_POLICY_DEFAULT
+}
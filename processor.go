@@ -1,13 +1,11 @@
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/rand"
-	"crypto/sha256"
-	"crypto/subtle"
-	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/pkg/profile"
@@ -15,58 +13,105 @@ import (
 
 // Actual processor, the hearth of the server
 
-func processor(signupReqChan chan SignupReq, authReqChan chan AuthReq, scanChan chan Scan) {
+func processor(cfg *Config, signupReqChan chan SignupReq, authReqChan chan AuthReq, scanChan chan Scan, ownerDecisionChan chan OwnerDecision, delegationChan chan DelegationReq) {
 
 	defer profile.Start(profile.ProfilePath(".")).Stop()
 
 	var (
-		nextDevId uint32 // Counter holding the newest unused device ID
-		// firstDev  bool   // Flag to signal it being the first device to sign up ==> Home owner device, which is then notified subsequently
-		err error // Error object
-
-		authReq   AuthReq   // Object holding authenticaion requests
-		signupReq SignupReq // Object holding one byte device type and then raw json data (SignupReq is a byte slice)
-		scan      Scan
-		scans     Scans       = make(Scans)
-		sState    ServerState = make(ServerState) // Server state
+		owner *HomeOwner = &HomeOwner{}
+		err   error      // Error object
+
+		authReq       AuthReq   // Object holding authenticaion requests
+		signupReq     SignupReq // Object holding one byte device type and then raw json data (SignupReq is a byte slice)
+		ownerDecision OwnerDecision
+		delegationReq DelegationReq
+		scan          Scan
+		scans         Scans             = make(Scans)
+		devices       *DeviceRegistry   = newDeviceRegistry()     // Server state
+		ownerChan     chan uint32       = make(chan uint32)       // Device IDs designated as home owner device on the console
+		releaseChan   chan string       = make(chan string)       // Names of leases force-released on the console
+		lifecycleChan chan LifecycleCmd = make(chan LifecycleCmd) // Devices suspended, resumed, revoked or deleted on the console or rejected by the home owner device
+
+		consoleDelegationChan chan DelegationReq = make(chan DelegationReq) // Delegations issued on the console. Unauthenticated, the console is trusted
 	)
 
+	// Restore the devices, scans and delegations stored before the last shutdown. The home owner device keeps its role, logs continue after the
+	// spilled entries
+	ids := newIdAllocator(cfg.RandomDevIds, cfg.IdQuarantine, cfg.Store.restore(devices, scans), devices, cfg.Store)
+	cfg.Delegations.restore(cfg.Store)
+	approved := false
+	devices.forEach(func(devState *DeviceState) bool {
+		devState.Log = newDeviceLog(devState.Id, cfg.LogBuffer, cfg.LogArchive, cfg.LogKey)
+		if devState.Owner {
+			owner.set(devState.Id)
+		}
+		approved = approved || !devState.Pending
+		return true
+	})
+
+	// Devices are only ever approved by a home owner device ==> Approved devices without one mean it was revoked or deleted
+	if _, hasOwner := owner.get(); !hasOwner && approved {
+		owner.retire()
+	}
+
+	go checkpointLogs(devices)
+
+	// Interrupts and terminations end the event loop, such that the logs are spilled and the store is closed before main exits
+	shutdownChan := make(chan os.Signal, 1)
+	signal.Notify(shutdownChan, os.Interrupt, syscall.SIGTERM)
+
+	// Authentication requests are checked and answered in parallel by the shards, this loop only routes them
+	shards := startAuthShards(cfg.AuthShards, cfg, devices, owner, lifecycleChan)
+
+	// Handshakes of signups are performed in parallel by the pool, this loop only creates the devices
+	handshakes := startHandshakePool(cfg.HandshakeWorkers, cfg.HandshakeQueue)
+
 	// DEBUG: Console task to poke the server
-	go consoleTask(&sState, scanChan)
+	go consoleTask(cfg, devices, handshakes, scanChan, ownerChan, releaseChan, consoleDelegationChan, lifecycleChan)
+
+	var heldSignupExpiredChan chan HeldSignupExpiry // Stays nil, i.e. never ready, if signups without scan are not held
+	if cfg.HeldSignups != nil {
+		heldSignupExpiredChan = cfg.HeldSignups.Expired
+	}
+
+	var leaseExpiredChan chan LeaseExpiry // Stays nil, i.e. never ready, if no leases are configured
+	if cfg.Leases != nil {
+		leaseExpiredChan = cfg.Leases.Expired
+	}
+
 	// Infinite event loop
 	for {
 		select {
 
 		case scan = <-scanChan:
 
-			// (1) Extract static public key from scan and check if it already exists
-			sPubGw := scan.SPubGW
-			_, scanExists := scans[sPubGw]
-
-			if scanExists {
-				// Case: Scanned key which already existed previously ==> Ignore
-				continue
-			}
-
-			// If we reached here, we know that the public key we received is fresh
-
-			// (2) Add scan to map of scans
-			scans[sPubGw] = scan
+			// Add scan to map of scans, unless its key is already scanned, and continue a signup which arrived before it
+			scanArrived(cfg, scans, handshakes, scan)
 
 		case signupReq = <-signupReqChan:
 
-			// TODO: Implement this block which sets the first device up as a home owner device
-			// // First device ==> Always a home owner device
-			// if firstDev {
-
-			// }
+			// (0) Check the device type against the registry
+			rejectReason := cfg.DeviceTypes.checkSignup(signupReq.DevType, signupReq.CapURI)
+			if rejectReason != SIGNUP_ACCEPTED {
+				fmt.Println("WARNING, processor, signupReq: Rejected signup of device type", cfg.DeviceTypes.name(signupReq.DevType), "with reason", rejectReason)
+				cfg.Audit.record(AUDIT_SIGNUP_REJECTED, nil, sourceOf(signupReq.Conn, signupReq.ConnId), fmt.Sprint("device type ", cfg.DeviceTypes.name(signupReq.DevType), " with reason ", rejectReason))
+				_, err = signupReq.Conn.Write(createSignupReject(rejectReason))
+				checkSuccessString("signupRequest, sending Signup Rejection", err)
+				continue
+			}
 
 			// (1) Perform the cryptographic handshake
 
 			// (1.1) Check if scan corresponding to the included key exists
 			sPubGw := signupReq.SPubGW
 
-			scan, scanExists := scans[sPubGw]
+			scan, scanExists := scans.lookup(cfg.Store, sPubGw, time.Now())
+			if !scanExists {
+				// Case: Scan consumed by an earlier signup of the key ==> Re-pair its device with the scan it consumed
+				if devState, exists := deviceOfKey(devices, sPubGw); exists {
+					scan, scanExists = devState.ScanData, true
+				}
+			}
 			if !scanExists {
 				// Case: Scan does NOT exist ==> Possible problem, possibly signup request without previously scanned key
 
@@ -75,19 +120,8 @@ func processor(signupReqChan chan SignupReq, authReqChan chan AuthReq, scanChan
 				for {
 					select {
 					case scan = <-scanChan:
-						// (1.1.1.1) Extract static public key from scan and check if it already exists
-						sPubGw := scan.SPubGW
-						scan, scanExists := scans[sPubGw]
-
-						if scanExists {
-							// Case: Scanned key which already existed previously ==> Ignore
-							continue
-						}
-
-						// If we reached here, we know that the public key we received is fresh
-
-						// (1.1.1.2) Add scan to map of scans
-						scans[sPubGw] = scan
+						// (1.1.1.1) Add scan to map of scans, unless its key is already scanned
+						scanArrived(cfg, scans, handshakes, scan)
 					default:
 						breakFlag = true
 					}
@@ -96,58 +130,38 @@ func processor(signupReqChan chan SignupReq, authReqChan chan AuthReq, scanChan
 					}
 				}
 
-				scan, scanExists = scans[sPubGw]
+				scan, scanExists = scans.lookup(cfg.Store, sPubGw, time.Now())
 				if !scanExists {
+					// (1.1.2) Hold the signup until the scan arrives, see signuphold.go
+					replaced, held := cfg.HeldSignups.hold(signupReq, time.Now())
+					if replaced != nil {
+						rejectUnprovisioned(cfg, replaced.SignupReq, "replaced by a later signup of the key")
+					}
+					if !held {
+						rejectUnprovisioned(cfg, signupReq, "signups without scan are not held or too many are held")
+						continue
+					}
+					fmt.Println("INFO, processor, signupReq: No scan of static public key", hex.EncodeToString(sPubGw[:]), "yet ==> Signup held for", cfg.HeldSignups.period)
 					continue
 				}
 			}
 
 			// If we reached here, we know that the Scan corresponding to the signup request's public key is store in scan
 
-			// (1.2) Create local X25519 ephemeral keypair
-			xSlice, xP, err := createEphemeralKeyPair()
-
-			// If we reached here, we have successfully created an ephemeral keypair!
-
-			// (1.3) Perform Diffie-Hellman on the keypairs
-
-			var x [KEY_LEN]byte
-
-			copy(x[:], xSlice)
-
-			if !checkSuccessString("signupRequest, Handshake, create Eph. keypair:", err) {
-				continue
-			}
-
-			ePubGw := signupReq.EPubGw
+			// (1.2) Hand the handshake to the pool. The device is created once it completes, see handshakeResult below
+			submitHandshake(cfg, handshakes, signupReq, scan)
 
-			// - - - - - - - - - - - - - - - - - -
+		case handshakeResult := <-handshakes.Done:
 
-			s1, err := diffieHellman(x, sPubGw)
+			// (1.3) The handshake of a signup completed
+			signupReq, scan = handshakeResult.SignupReq, handshakeResult.Scan
+			xP, ePubGw, sessKeys := handshakeResult.XP, signupReq.EPubGw, handshakeResult.Sesskeys
 
-			if !checkSuccessString("signupRequest, Handshake diffieHellman of s1:", err) {
+			if handshakeResult.Failed {
+				rejectSignupServerError(cfg, signupReq, "handshake failed")
 				continue
 			}
 
-			s2, err := diffieHellman(x, ePubGw)
-			if !checkSuccessString("signupRequest, Handshake diffieHellman of s2:", err) {
-				continue
-			}
-
-			// (1.4) Derive two keys, one for gw->server authentication and one for server->gw authentication
-			ikm := append(append(s1[:], s2[:]...), scan.Psk[:]...)
-
-			var salt [16]byte
-
-			infos := make([][]byte, 2)
-
-			infos[0] = []byte("gw_s")
-			infos[1] = []byte("s_gw")
-
-			keys := Hkdf(ikm, salt, infos)
-
-			sessKeys := Sessionkeys{K_gw_s: keys[0], K_s_gw: keys[1]}
-
 			// If we reached here, we have successfully LOCALLY established the keys.
 			// We still need confirmation that the gateway has derived the same keys, thus the pairing flag of the DeviceState to be created is set to FALSE
 
@@ -156,16 +170,30 @@ func processor(signupReqChan chan SignupReq, authReqChan chan AuthReq, scanChan
 			// (2) Extract the device type
 			devType := signupReq.DevType
 
+			// (2.1) A key which already signed up re-pairs its device instead of creating another one. NOTE: Looked up again, as the device may
+			//		 have been revoked or deleted during the handshake
+			if devState, exists := deviceOfKey(devices, scan.SPubGW); exists {
+				if repairDevice(cfg, devices, devState, handshakeResult) {
+					scans.consume(cfg.Store, scan.SPubGW)
+				}
+				continue
+			}
+
 			// (3) Add device to state
-			// (3.1) Create empty log
-			log := make([]LogEntry, 0)
+			// (3.1) Get an unused device ID
+			devId, allocated := ids.allocate()
+			if !allocated {
+				cfg.Audit.record(AUDIT_SIGNUP_REJECTED, nil, sourceOf(signupReq.Conn, signupReq.ConnId), "device IDs are exhausted")
+				_, err = signupReq.Conn.Write(createSignupReject(SIGNUP_REJECT_IDS_EXHAUSTED))
+				checkSuccessString("signupRequest, sending Signup Rejection", err)
+				continue
+			}
 
-			// (3.2) Get device ID and increment the global counter
-			devId := nextDevId
-			nextDevId += 1
+			// (3.2) Create empty log
+			log := newDeviceLog(devId, cfg.LogBuffer, cfg.LogArchive, cfg.LogKey)
 
 			// (3.3) Set state
-			sState[devId] = DeviceState{ // TODO: Add Pubkey
+			devState := DeviceState{ // TODO: Add Pubkey
 				Conn:           signupReq.Conn,
 				Id:             devId,
 				Type:           devType,
@@ -175,18 +203,41 @@ func processor(signupReqChan chan SignupReq, authReqChan chan AuthReq, scanChan
 				CapURI:         string(signupReq.CapURI),
 				Sesskeys:       sessKeys,
 				Paired:         false,
+				Pending:        true, // Every device awaits approval, unless it pairs first and thereby becomes the home owner device
 				ScanData:       scan,
 				Log:            log,
 			}
 
+			// (3.4) Make the device durable before it becomes visible and learns its ID
+			if !cfg.Store.putDevice(&devState) {
+				ids.unallocate(devId)
+				rejectSignupServerError(cfg, signupReq, "device could not be stored")
+				continue
+			}
+			devices.add(devState)
+
+			// (3.5) The scan is used up, further signups of the key re-pair the device, see (2.1)
+			scans.consume(cfg.Store, scan.SPubGW)
+			fmt.Println("INFO, processor: Scan", scan.name(), "consumed by the signup of device", devId)
+
 			fmt.Println("DEBUG: Received signupReq:", signupReq)
 			fmt.Println("DEBUG: Device capability URI:", string(signupReq.CapURI))
-			fmt.Println("DEBUG: Assigned device ID:", devId)
+
+			// (3.6) Start fetching the capability document, such that it is cached by the time the first authentication request arrives
+			if cfg.Capabilities != nil {
+				cfg.Capabilities.lookup(string(signupReq.CapURI), devType)
+			}
+			fmt.Println("DEBUG: Assigned device ID:", devId, "to device of type", cfg.DeviceTypes.name(devType))
 
 			fmt.Println("-------------------------------------")
-			fmt.Printf("%+v\n", sState[devId])
+			fmt.Printf("%+v\n", devState)
 			fmt.Println("-------------------------------------")
 
+			// (3.7) Ask the home owner device to approve the new device
+			if ownerState := owner.state(devices); ownerState != nil {
+				sendOwnerAlert(ownerState, OWNER_KIND_SIGNUP, devId, devId, devType)
+			}
+
 			// (4) Send signup response
 
 			//	   Recall, the signup response here has structure:
@@ -202,137 +253,104 @@ func processor(signupReqChan chan SignupReq, authReqChan chan AuthReq, scanChan
 			checkSuccessString("signupRequest, Handshake, sending Signup Response", err)
 		case authReq = <-authReqChan:
 
-			fmt.Println("DEBUG: Received autReq:", authReq)
+			// Checked and answered by the device's shard
+			shards.of(authReq.DevId).authChan <- authReq
 
-			var devId uint32 = authReq.DevId
+		case devId := <-ownerChan:
+			// Home owner device designated by the admin
+			owner.designate(cfg.Store, devices, devId, false)
 
-			// (1) Check if device ID exists
-			devState, exists := sState[devId]
-			if !exists {
-				continue
-			}
+		case ownerDecision = <-ownerDecisionChan:
 
-			// (2) Append to log
+			// Checked against the sender's counters by the sender's shard, which rejects it unless the sender is the home owner device
+			shards.of(ownerDecision.DevId).ownerDecisionChan <- ownerDecision
 
-			//(2.1) Create new log entry
-			logEntry := LogEntry{ArrivalTime: time.Now(), Paired: devState.Paired, AuthReq: authReq}
+		case delegationReq = <-delegationChan:
 
-			// (2.2) Append log entry to the log
-			devState.Log = append(devState.Log, logEntry)
+			// Likewise checked by the sender's shard
+			shards.of(delegationReq.DevId).delegationChan <- delegationReq
 
-			//FIXME: This is inefficient, it would be better to just have a map to REFERENCES of device states!
+		case cmd := <-lifecycleChan:
 
-			// (2.3) Write back log
-			sState[devId] = devState
+			// Device suspended, resumed, revoked or deleted by the admin, or rejected by the home owner device
+			applyLifecycle(cfg, devices, owner, shards, scans, ids, cmd)
 
-			// (3) Check request for freshness and authenticity
-			// (3.1) Get Server->Gateway key
-			chalKey := devState.Sesskeys.K_gw_s
-			authKey := devState.Sesskeys.K_s_gw
+		case delegationReq = <-consoleDelegationChan:
 
-			// (3.2) Create HMAC functor to check the request
-			chalHmacer := hmac.New(sha256.New, chalKey)
+			// Delegation issued or revoked by the admin
+			applyDelegation(cfg, devices, delegationReq, "console")
 
-			// (3.3) Check if challenge is fresh and authentic
+		case expiry := <-heldSignupExpiredChan:
 
-			// (3.3.1) Check if counters are at least as large as current counters. This creates a sidechannel where attacker can learn expected counter value
-			if authReq.RebCnt < devState.rebCnt {
-				// CASE: Request before a previous reboot of the gateway ==> old request
-				fmt.Println("WARNING, processor, authReq: Authentication Request has old rebCnt")
-				continue
+			// No scan arrived for a held signup ==> The gateway is not provisioned
+			if held, exists := cfg.HeldSignups.expire(expiry); exists {
+				rejectUnprovisioned(cfg, held.SignupReq, fmt.Sprint("no scan within ", cfg.HeldSignups.period))
 			}
 
-			if authReq.ReqCnt < devState.reqCnt {
-				// CASE: Request's boot counter is fresh but request counter is less than the server's counter ==> old request
-				fmt.Println("WARNING, processor, authReq: Authentication Request has old reqCnt")
+		case expiry := <-leaseExpiredChan:
 
-				continue
+			// The lease was neither renewed nor released in time ==> Free it and hand it to the next waiting request
+			if cfg.Leases.expire(expiry) {
+				fmt.Println("INFO, processor, lease: Lease", expiry.Name, "expired")
+				handOffLease(cfg, devices, shards, expiry.Name)
 			}
 
-			// (3.3.2) Create slice to MAC over
-			macInput := make([]byte, REB_CNT_LEN+REQ_CNT_LEN+ACCESS_TYPE_LEN+RANDOM_LEN)
-			// WARNING: If REB_CNT_LEN != 4, the following fails because it copies 32 bits (4 bytes)!
-			binary.LittleEndian.PutUint32(macInput, authReq.RebCnt)
-			binary.LittleEndian.PutUint32(macInput[REB_CNT_LEN:], authReq.ReqCnt)
-			binary.LittleEndian.PutUint16(macInput[REB_CNT_LEN+REQ_CNT_LEN:], authReq.AccessType)
-			copy(macInput[REB_CNT_LEN+REQ_CNT_LEN+ACCESS_TYPE_LEN:], devState.LastRandomness)
-
-			// (3.3.3) Check MAC-tag
-			_, err = chalHmacer.Write(macInput)
-			if !checkSuccessString("processor, authReq, chalHmac digesting message", err) {
-				continue
-			}
+		case received := <-shutdownChan:
 
-			// (3.3.4) Compute digest
-			macTag := chalHmacer.Sum(nil)
+			// Returning runs the deferred profile stop. NOTE: Appends of the shards block on the closed logs or fail on the closed store from here on
+			fmt.Println("INFO, processor: Received", received, "==> Spilling the logs and closing the store")
+			closeLogs(cfg.LogArchive, devices)
+			cfg.Store.close()
+			return
 
-			// (3.3.5) Compare with included tag
-			macEquals := subtle.ConstantTimeCompare(macTag, authReq.MacTag)
-			if macEquals != 1 {
-				// 1§ : MAC Tags disagree
-				fmt.Println("WARNING, processor, authReq: Authentication Request has bad MAC Tag")
-				continue
-			}
-
-			// If we reach here, the request is fresh and authentic
-
-			// NOTE: If the device had not been paired previously, we here set the flag as paired because the device has proven that it knows the key,
-			//		 so we know the device is fully paired!
+		case name := <-releaseChan:
 
-			if authReq.AccessType == DUMMY_REQUEST {
-				// NOTE: The DUMMY_REQUEST does NOT change the randomness field stored in the device state.
-				//       That is because no response (holding randomness) is ever created by the server!
-				devState.Paired = true
-				fmt.Println("DEBUG, processor, authReq: Received authentic pairing dummy message ==> Now (re)paired")
+			// Lease force-released on the console
+			if cfg.Leases == nil {
 				continue
 			}
-
-			fmt.Println("DEBUG, processor, authReq: Received fresh and authentic authentication request from device:", devId)
-
-			// (4) Create authentic response
-
-			// (4.2) Create slice to MAC over. It holds:
-			//		 |  sRandom  |  authReq.macTag  |
-			respSlice := make([]byte, RANDOM_LEN+HMAC_OUTPUT_SIZE)
-			_, err := rand.Read(respSlice[:RANDOM_LEN])
-			if !checkSuccessString("processor, authReq, randomness generation", err) {
-				continue
+			if cfg.Leases.release(name) {
+				fmt.Println("INFO, processor, lease: Lease", name, "force-released")
 			}
-			copy(respSlice[RANDOM_LEN:], authReq.MacTag)
-
-			// CHANGE: Moved this down
-			// (4.3) Update the server's counters AND LastRandomness and write changes back to server State sState
-			devState.rebCnt = authReq.RebCnt
-			devState.reqCnt = authReq.ReqCnt
-			devState.LastRandomness = respSlice[:RANDOM_LEN]
-			sState[devId] = devState
-
-			// (4.4) Create authentication MAC tag over respSlice
-			authHmacer := hmac.New(sha256.New, authKey)
+			handOffLease(cfg, devices, shards, name)
+		}
+	}
+}
 
-			_, err = authHmacer.Write(respSlice)
-			if !checkSuccessString("processor, authReq, authHmac digesting message", err) {
-				continue
-			}
+// Grants the oldest request waiting for the now free lease. Its response is sent by the device's shard
+func handOffLease(cfg *Config, devices *DeviceRegistry, shards *AuthShards, name string) {
+	for {
+		next, exists := cfg.Leases.handOff(name, time.Now())
+		if !exists {
+			return
+		}
 
-			authTag := authHmacer.Sum(nil)
+		// The device may have been removed while waiting ==> Pass the lease on
+		if !devices.exists(next.AuthReq.DevId) {
+			cfg.Leases.release(name)
+			continue
+		}
 
-			// (4.5) Create final response payload.
-			//		 We take the current respSlice:              |  sRandom  |  authReq.macTag  |
-			//		 and overwrite the old with the new MAC-Tag: |  sRandom  |     authTag      |
-			copy(respSlice[RANDOM_LEN:], authTag)
+		fmt.Println("INFO, processor, lease: Lease", name, "handed to device", next.AuthReq.DevId, "after waiting", time.Since(next.QueuedAt))
+		shards.of(next.AuthReq.DevId).leaseChan <- next
+		return
+	}
+}
 
-			// (5) Send response
-			// (5.1) Allocate message buffer, populate it to hold: |  header  |  sRandom  |  authTag  |
-			authMsg := make([]byte, HEADER_LEN+LEN_PAYLOAD_AUTH_RESP)
-			buildMsg(authMsg, PAYLOAD_AUTH_RESP, respSlice)
+// Tells the gateway that its signup failed on the server's side, such that it retries instead of waiting for a response
+func rejectSignupServerError(cfg *Config, signupReq SignupReq, details string) {
+	fmt.Println("WARNING, processor, signupReq: Signup failed,", details, "==> Rejected signup")
+	cfg.Audit.record(AUDIT_SIGNUP_REJECTED, nil, sourceOf(signupReq.Conn, signupReq.ConnId), details)
+	_, err := signupReq.Conn.Write(createSignupReject(SIGNUP_REJECT_SERVER_ERROR))
+	checkSuccessString("signupRequest, sending Signup Rejection", err)
+}
 
-			// (5.2) Send message over connection
-			n, err := devState.Conn.Write(authMsg)
-			if !checkSuccessString("processor, authReq, sending message", err) {
-				// If partial message was sent, print what was sent
-				fmt.Println("ERROR /2: n =", n, "bytes were written, which means message: \""+hex.EncodeToString(authMsg[:n])+"\"")
-			}
-		}
+// Hands the signup to the handshake pool. The device is created once the handshake completes, see handshakeResult in processor
+func submitHandshake(cfg *Config, handshakes *HandshakePool, signupReq SignupReq, scan Scan) {
+	if !handshakes.submit(signupReq, scan) {
+		fmt.Println("WARNING, processor, signupReq: Handshake queue is full ==> Rejected signup")
+		cfg.Audit.record(AUDIT_SIGNUP_REJECTED, nil, sourceOf(signupReq.Conn, signupReq.ConnId), "handshake queue is full")
+		_, err := signupReq.Conn.Write(createSignupReject(SIGNUP_REJECT_BUSY))
+		checkSuccessString("signupRequest, sending Signup Rejection", err)
 	}
 }
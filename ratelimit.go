@@ -0,0 +1,307 @@
+// Per-device rate limiting and daily quotas, guarding actuators against runaway or compromised gateways
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limit of a token bucket and a daily quota. Zero values disable the respective limit
+type RateLimit struct {
+	Rate  float64 `json:"rate"`  // Tokens refilled per second
+	Burst float64 `json:"burst"` // Capacity of the bucket, i.e. requests granted back to back
+	Daily uint32  `json:"daily"` // Requests granted per day
+}
+
+// Rate limit file layout:
+//
+//	{
+//	  "device":      { "rate": 2, "burst": 20, "daily": 20000 },
+//	  "default":     { "rate": 1, "burst": 10 },
+//	  "accessTypes": { "CONTROL_ACTUATOR_0": { "rate": 0.1, "burst": 2, "daily": 100 } },
+//	  "devices":     { "3": { "CONTROL_ACTUATOR_0": { "rate": 0.5, "burst": 5 } } }
+//	}
+//
+// "device" limits the sum of all access types of a device. Every access type of a device is limited in addition by the first of:
+// the entry in "devices" for the device ID, the entry in "accessTypes", "default"
+type RateLimitConfig struct {
+	Device      *RateLimit                       `json:"device"`
+	Default     *RateLimit                       `json:"default"`
+	AccessTypes map[string]*RateLimit            `json:"accessTypes"`
+	Devices     map[string]map[string]*RateLimit `json:"devices"`
+
+	accessTypes map[uint16]*RateLimit            // AccessTypes resolved to numerical access types
+	devices     map[uint32]map[uint16]*RateLimit // Devices resolved to numerical device IDs and access types
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Refills the bucket for the time passed since the last refill
+func (b *tokenBucket) refill(limit *RateLimit, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	if b.tokens > limit.Burst {
+		b.tokens = limit.Burst
+	}
+	b.last = now
+}
+
+// Returns a token taken for a request which was denied afterwards
+func (b *tokenBucket) giveBack(limit *RateLimit) {
+	b.tokens += 1
+	if b.tokens > limit.Burst {
+		b.tokens = limit.Burst
+	}
+}
+
+// Usage of a single device, shown on the console
+type DeviceUsage struct {
+	Day           string            // Day the daily counters refer to, as YYYY-MM-DD in local time
+	Daily         map[uint16]uint32 // Granted requests per access type on Day
+	DailyTotal    uint32            // Granted requests on Day
+	Granted       uint64            // Granted requests since startup
+	RateLimited   uint64            // Requests denied by a token bucket since startup
+	QuotaExceeded uint64            // Requests denied by a daily quota since startup
+
+	buckets      map[uint16]*tokenBucket
+	deviceBucket *tokenBucket
+}
+
+type RateLimiter struct {
+	mu     sync.Mutex
+	config *RateLimitConfig
+	usages map[uint32]*DeviceUsage
+}
+
+func loadRateLimits(path string) (*RateLimiter, error) {
+
+	// (1) Read and parse the rate limit file
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &RateLimitConfig{}
+	err = json.Unmarshal(raw, config)
+	if err != nil {
+		return nil, &InvalidRateLimits{Path: path, Reason: err.Error()}
+	}
+
+	// (2) Resolve access type names and device IDs
+	config.accessTypes, err = resolveRateLimits(path, config.AccessTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	config.devices = make(map[uint32]map[uint16]*RateLimit)
+	for devIdString, limits := range config.Devices {
+		devId, err := strconv.ParseUint(devIdString, 10, 32)
+		if err != nil {
+			return nil, &InvalidRateLimits{Path: path, Reason: "invalid device ID \"" + devIdString + "\""}
+		}
+		config.devices[uint32(devId)], err = resolveRateLimits(path, limits)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// (3) Check that every bucket can hold at least one token
+	for _, limit := range []*RateLimit{config.Device, config.Default} {
+		err = checkRateLimit(path, limit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &RateLimiter{config: config, usages: make(map[uint32]*DeviceUsage)}, nil
+}
+
+func resolveRateLimits(path string, named map[string]*RateLimit) (map[uint16]*RateLimit, error) {
+	resolved := make(map[uint16]*RateLimit)
+	for name, limit := range named {
+		accessType, exists := ACCESS_TYPE_NAMES[name]
+		if !exists {
+			return nil, &InvalidRateLimits{Path: path, Reason: "unknown access type \"" + name + "\""}
+		}
+		err := checkRateLimit(path, limit)
+		if err != nil {
+			return nil, err
+		}
+		resolved[accessType] = limit
+	}
+	return resolved, nil
+}
+
+func checkRateLimit(path string, limit *RateLimit) error {
+	if limit != nil && limit.Rate > 0 && limit.Burst < 1 {
+		return &InvalidRateLimits{Path: path, Reason: "burst must be at least 1 if a rate is set"}
+	}
+	return nil
+}
+
+// Returns the limit of the access type of the device, or nil if it is unlimited
+func (c *RateLimitConfig) limitFor(devId uint32, accessType uint16) *RateLimit {
+	if limit, exists := c.devices[devId][accessType]; exists {
+		return limit
+	}
+	if limit, exists := c.accessTypes[accessType]; exists {
+		return limit
+	}
+	return c.Default
+}
+
+// Returns the usage of the device, creating it and rolling the daily counters over as needed. The caller must hold the lock
+func (l *RateLimiter) usageOf(devId uint32, now time.Time) *DeviceUsage {
+	usage, exists := l.usages[devId]
+	if !exists {
+		usage = &DeviceUsage{buckets: make(map[uint16]*tokenBucket)}
+		l.usages[devId] = usage
+	}
+
+	day := now.Format("2006-01-02")
+	if usage.Day != day {
+		usage.Day = day
+		usage.Daily = make(map[uint16]uint32)
+		usage.DailyTotal = 0
+	}
+
+	return usage
+}
+
+// Returns the bucket for the limit, refilled up to now. A bucket is created full. Returns nil if the limit has no rate
+func takeBucket(bucket **tokenBucket, limit *RateLimit, now time.Time) *tokenBucket {
+	if limit == nil || limit.Rate <= 0 {
+		return nil
+	}
+	if *bucket == nil {
+		*bucket = &tokenBucket{tokens: limit.Burst, last: now}
+	}
+	(*bucket).refill(limit, now)
+	return *bucket
+}
+
+// Returns the decision and reason code for a request of the device, and counts it as granted if it passes all limits. A nil limiter grants everything
+func (l *RateLimiter) admit(devId uint32, accessType uint16, now time.Time) (uint8, uint8) {
+	if l == nil {
+		return DECISION_ALLOW, REASON_NONE
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	usage := l.usageOf(devId, now)
+	limit := l.config.limitFor(devId, accessType)
+	deviceLimit := l.config.Device
+
+	// (1) Check the daily quotas
+	if (limit != nil && limit.Daily > 0 && usage.Daily[accessType] >= limit.Daily) || (deviceLimit != nil && deviceLimit.Daily > 0 && usage.DailyTotal >= deviceLimit.Daily) {
+		usage.QuotaExceeded += 1
+		return DECISION_DENY, REASON_QUOTA_EXCEEDED
+	}
+
+	// (2) Check the token buckets. Tokens are only taken if both buckets have one, such that a denied request costs nothing
+	bucket := usage.buckets[accessType]
+	accessBucket := takeBucket(&bucket, limit, now)
+	usage.buckets[accessType] = bucket
+	deviceBucket := takeBucket(&usage.deviceBucket, deviceLimit, now)
+
+	if (accessBucket != nil && accessBucket.tokens < 1) || (deviceBucket != nil && deviceBucket.tokens < 1) {
+		usage.RateLimited += 1
+		return DECISION_DENY, REASON_RATE_LIMITED
+	}
+
+	if accessBucket != nil {
+		accessBucket.tokens -= 1
+	}
+	if deviceBucket != nil {
+		deviceBucket.tokens -= 1
+	}
+
+	// (3) Count the granted request
+	usage.Daily[accessType] += 1
+	usage.DailyTotal += 1
+	usage.Granted += 1
+
+	return DECISION_ALLOW, REASON_NONE
+}
+
+// Undoes what admit counted for a request admitted at the given time but denied by a later step, e.g. by the home owner device or a held lease,
+// such that only granted requests drain the buckets and quotas. A nil limiter counts nothing
+func (l *RateLimiter) refund(devId uint32, accessType uint16, admitted time.Time) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	usage, exists := l.usages[devId]
+	if !exists {
+		return
+	}
+
+	if limit := l.config.limitFor(devId, accessType); usage.buckets[accessType] != nil && limit != nil {
+		usage.buckets[accessType].giveBack(limit)
+	}
+	if usage.deviceBucket != nil && l.config.Device != nil {
+		usage.deviceBucket.giveBack(l.config.Device)
+	}
+
+	// The daily counters are rolled over already if the request was admitted on the day before
+	if usage.Day == admitted.Format("2006-01-02") && usage.Daily[accessType] > 0 {
+		usage.Daily[accessType] -= 1
+		usage.DailyTotal -= 1
+	}
+	if usage.Granted > 0 {
+		usage.Granted -= 1
+	}
+}
+
+// Drops the device's buckets and quotas. A nil limiter holds none
+func (l *RateLimiter) forget(devId uint32) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.usages, devId)
+}
+
+// Prints the counters of the device to the console
+func (l *RateLimiter) printUsage(devId uint32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	usage, exists := l.usages[devId]
+	if !exists {
+		fmt.Printf("CONSOLE: Device ID %v has not been rate limited yet\n", devId)
+		return
+	}
+
+	fmt.Printf("CONSOLE: - - - - - Rate limit counters for device ID: %v - - - - -\n", devId)
+	fmt.Printf("Granted: %v, Rate limited: %v, Quota exceeded: %v\n", usage.Granted, usage.RateLimited, usage.QuotaExceeded)
+	fmt.Printf("Granted on %v: %v\n", usage.Day, usage.DailyTotal)
+
+	accessTypes := make([]int, 0, len(usage.Daily))
+	for accessType := range usage.Daily {
+		accessTypes = append(accessTypes, int(accessType))
+	}
+	sort.Ints(accessTypes)
+
+	for _, accessType := range accessTypes {
+		tokens := "unlimited"
+		if bucket, exists := usage.buckets[uint16(accessType)]; exists && bucket != nil {
+			tokens = strconv.FormatFloat(bucket.tokens, 'f', 2, 64)
+		}
+		fmt.Printf("Access Type: %v, Granted today: %v, Tokens left: %v\n", accessType, usage.Daily[uint16(accessType)], tokens)
+	}
+}
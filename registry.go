@@ -0,0 +1,163 @@
+// Registry owning the device records, safe for concurrent use by the processor, the console and the admin interfaces
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+type deviceRecord struct {
+	mu      sync.Mutex
+	state   DeviceState
+	removed bool // Set once the store deleted the device, such that no commit holding the record from before persists it again
+}
+
+// NOTE: Callbacks run under the lock of a single record and must not call back into the registry.
+// No goroutine ever holds two record locks, so the registry cannot deadlock
+type DeviceRegistry struct {
+	mu      sync.RWMutex // Guards the map, not the records
+	devices map[uint32]*deviceRecord
+}
+
+func newDeviceRegistry() *DeviceRegistry {
+	return &DeviceRegistry{devices: make(map[uint32]*deviceRecord)}
+}
+
+func (r *DeviceRegistry) record(devId uint32) (*deviceRecord, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rec, exists := r.devices[devId]
+	return rec, exists
+}
+
+// Adds the device, replacing any device with the same ID
+func (r *DeviceRegistry) add(devState DeviceState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.devices[devState.Id] = &deviceRecord{state: devState}
+}
+
+// Deletes the device from the store and removes it. Returns false if it does not exist or the store failed, in which case it is kept.
+// NOTE: Deleted under the record's lock, such that a concurrent commit either is journaled before the deletion or fails
+func (r *DeviceRegistry) remove(store *Store, devId uint32) bool {
+	rec, exists := r.record(devId)
+	if !exists {
+		return false
+	}
+
+	rec.mu.Lock()
+	if rec.removed || !store.deleteDevice(devId) {
+		rec.mu.Unlock()
+		return false
+	}
+	rec.removed = true
+	rec.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.devices[devId] == rec {
+		delete(r.devices, devId)
+	}
+	return true
+}
+
+func (r *DeviceRegistry) exists(devId uint32) bool {
+	_, exists := r.record(devId)
+	return exists
+}
+
+func (r *DeviceRegistry) count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.devices)
+}
+
+// Returns the IDs of all devices in ascending order
+func (r *DeviceRegistry) ids() []uint32 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]uint32, 0, len(r.devices))
+	for id := range r.devices {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Returns a copy of the device's state. NOTE: The copy shares the log with the registry, which is safe for concurrent use
+func (r *DeviceRegistry) get(devId uint32) (DeviceState, bool) {
+	rec, exists := r.record(devId)
+	if !exists {
+		return DeviceState{}, false
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	return rec.state, true
+}
+
+// Runs fn on the device's state under its lock. Returns false if the device does not exist
+func (r *DeviceRegistry) update(devId uint32, fn func(devState *DeviceState)) bool {
+	rec, exists := r.record(devId)
+	if !exists {
+		return false
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.removed {
+		return false
+	}
+
+	fn(&rec.state)
+	return true
+}
+
+// Runs fn on a copy of the device's state and commits the copy only once the store persisted it. Returns false if the device does not exist or
+// the store failed, in which case the state is unchanged
+func (r *DeviceRegistry) commit(store *Store, devId uint32, fn func(devState *DeviceState)) bool {
+	rec, exists := r.record(devId)
+	if !exists {
+		return false
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.removed {
+		return false
+	}
+	updated := rec.state
+	fn(&updated)
+	if !store.putDevice(&updated) {
+		return false
+	}
+	rec.state = updated
+	return true
+}
+
+// Runs fn on every device's state in ascending ID order, each under its lock, until fn returns false
+func (r *DeviceRegistry) forEach(fn func(devState *DeviceState) bool) {
+	for _, id := range r.ids() {
+		rec, exists := r.record(id)
+		if !exists {
+			// Case: Removed since ids() was called
+			continue
+		}
+
+		rec.mu.Lock()
+		more := fn(&rec.state)
+		rec.mu.Unlock()
+
+		if !more {
+			return
+		}
+	}
+}
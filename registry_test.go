@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_DEVICES  = 16 // Devices sending requests, spread over the shards
+	TEST_REQUESTS = 50 // Requests per device
+)
+
+// Returns both ends of a loopback TCP connection, the server's end as the shards expect it
+func tcpPair(t *testing.T) (*net.TCPConn, net.Conn) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close(); server.Close() })
+	return server, client
+}
+
+// Paired device whose responses arrive on the returned gateway end
+func testDevice(t *testing.T, devId uint32) (DeviceState, net.Conn) {
+	server, gateway := tcpPair(t)
+	keys := Sessionkeys{K_gw_s: make([]byte, 32), K_s_gw: make([]byte, 32)}
+	rand.Read(keys.K_gw_s)
+	rand.Read(keys.K_s_gw)
+
+	devState := DeviceState{Id: devId, Sesskeys: keys, LastRandomness: make([]byte, RANDOM_LEN), Paired: true, Conn: server, Log: newDeviceLog(devId, 8, nil, nil)}
+	return devState, gateway
+}
+
+// Sends the authentic requests 1, 2, ... of the device to its shard, each after the response to the previous one
+func sendRequests(t *testing.T, shards *AuthShards, devState DeviceState, gateway net.Conn) {
+	lastRandomness := devState.LastRandomness
+	for reqCnt := uint32(1); reqCnt <= TEST_REQUESTS; reqCnt++ {
+		macInput := make([]byte, REB_CNT_LEN+REQ_CNT_LEN+ACCESS_TYPE_LEN+RANDOM_LEN)
+		binary.LittleEndian.PutUint32(macInput[REB_CNT_LEN:], reqCnt)
+		binary.LittleEndian.PutUint16(macInput[REB_CNT_LEN+REQ_CNT_LEN:], SAMPLE_SENSOR_0)
+		copy(macInput[REB_CNT_LEN+REQ_CNT_LEN+ACCESS_TYPE_LEN:], lastRandomness)
+		macer := hmac.New(sha256.New, devState.Sesskeys.K_gw_s)
+		macer.Write(macInput)
+
+		shards.of(devState.Id).authChan <- AuthReq{DevId: devState.Id, AccessType: SAMPLE_SENSOR_0, ReqCnt: reqCnt, MacTag: macer.Sum(nil)}
+
+		resp := make([]byte, HEADER_LEN+LEN_PAYLOAD_AUTH_RESP)
+		gateway.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err := io.ReadFull(gateway, resp)
+		if err != nil {
+			t.Errorf("device %v, request %v: %v", devState.Id, reqCnt, err)
+			return
+		}
+		lastRandomness = resp[HEADER_LEN+DECISION_LEN+REASON_LEN : HEADER_LEN+DECISION_LEN+REASON_LEN+RANDOM_LEN]
+	}
+}
+
+// Drives the shards and the registry from many goroutines at once, meant to be run with -race
+func TestRegistryConcurrentShards(t *testing.T) {
+	devices := newDeviceRegistry()
+	gateways := make(map[uint32]net.Conn)
+	for devId := uint32(0); devId < TEST_DEVICES; devId++ {
+		devState, gateway := testDevice(t, devId)
+		devices.add(devState)
+		gateways[devId] = gateway
+	}
+	shards := startAuthShards(4, &Config{}, devices, &HomeOwner{}, nil)
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+
+	// (1) Every device sends its requests
+	for devId, gateway := range gateways {
+		devState, _ := devices.get(devId)
+		wg.Add(1)
+		go func(devState DeviceState, gateway net.Conn) {
+			defer wg.Done()
+			sendRequests(t, shards, devState, gateway)
+		}(devState, gateway)
+	}
+
+	// (2) Meanwhile, devices come and go and the registry is read and written as by the processor and the console
+	var churn sync.WaitGroup
+	churn.Add(1)
+	go func() {
+		defer churn.Done()
+		for devId := uint32(TEST_DEVICES); ; devId++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			devices.add(DeviceState{Id: devId, Log: newDeviceLog(devId, 8, nil, nil)})
+			devices.forEach(func(devState *DeviceState) bool {
+				_ = devState.reqCnt
+				return true
+			})
+			devices.update(devId%TEST_DEVICES, func(devState *DeviceState) { devState.CapURI = "file:///dev/null" })
+			devices.get(devId % TEST_DEVICES)
+			devices.remove(nil, devId)
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	churn.Wait()
+
+	// (3) Every request was answered and consumed its counter, in order
+	for devId := uint32(0); devId < TEST_DEVICES; devId++ {
+		devState, exists := devices.get(devId)
+		if !exists {
+			t.Fatalf("device %v vanished", devId)
+		}
+		if devState.reqCnt != TEST_REQUESTS {
+			t.Errorf("device %v: reqCnt %v, expected %v", devId, devState.reqCnt, TEST_REQUESTS)
+		}
+		if devState.Log.length() != TEST_REQUESTS {
+			t.Errorf("device %v: %v log entries, expected %v", devId, devState.Log.length(), TEST_REQUESTS)
+		}
+	}
+	if devices.count() != TEST_DEVICES {
+		t.Errorf("%v devices, expected %v", devices.count(), TEST_DEVICES)
+	}
+}
@@ -0,0 +1,169 @@
+// Lifecycle of scans: a scan expires after its TTL and is consumed by the first successful signup of its static public key. Later signups of
+// the key re-pair the device created by it instead of creating another one
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Returns true if the scan's TTL has passed. Scans without TTL never expire
+func (s *Scan) expired(now time.Time) bool {
+	return s.TTL > 0 && now.After(s.Created.Add(s.TTL))
+}
+
+// Returns the label of the scan or the static public key if it has none, for log messages
+func (s *Scan) name() string {
+	if s.Label != "" {
+		return "\"" + s.Label + "\""
+	}
+	return hex.EncodeToString(s.SPubGW[:])
+}
+
+// Adds a fresh scan. A scan of a key which is already scanned is ignored. Expired scans are removed along the way, such that they do not pile up
+func (scans Scans) add(store *Store, scan Scan, now time.Time) {
+	scans.prune(store, now)
+
+	if _, exists := scans[scan.SPubGW]; exists {
+		// Case: Scanned key which already existed previously ==> Ignore
+		return
+	}
+	if scan.expired(now) {
+		fmt.Println("WARNING, scan: Scan", scan.name(), "expired before it was processed ==> Ignored")
+		return
+	}
+
+	if !store.putScan(scan) {
+		return
+	}
+	scans[scan.SPubGW] = scan
+}
+
+// Removes the expired scans
+func (scans Scans) prune(store *Store, now time.Time) {
+	for sPubGw, scan := range scans {
+		if scan.expired(now) && store.deleteScan(sPubGw) {
+			delete(scans, sPubGw)
+			fmt.Println("INFO, scan: Scan", scan.name(), "expired without a signup")
+		}
+	}
+}
+
+// Returns the scan of the key, unless it expired
+func (scans Scans) lookup(store *Store, sPubGw [KEY_LEN]byte, now time.Time) (Scan, bool) {
+	scan, exists := scans[sPubGw]
+	if !exists {
+		return Scan{}, false
+	}
+	if scan.expired(now) {
+		if store.deleteScan(sPubGw) {
+			delete(scans, sPubGw)
+		}
+		fmt.Println("WARNING, scan: Scan", scan.name(), "expired before the signup")
+		return Scan{}, false
+	}
+	return scan, true
+}
+
+// Removes the scan once a signup used it, such that the key cannot create another device
+func (scans Scans) consume(store *Store, sPubGw [KEY_LEN]byte) {
+	if _, exists := scans[sPubGw]; exists && store.deleteScan(sPubGw) {
+		delete(scans, sPubGw)
+	}
+}
+
+// Returns the device which signed up with the static public key, paired or not, e.g. if its signup response got lost.
+// Revoked devices hold no scan data and are never returned
+func deviceOfKey(devices *DeviceRegistry, sPubGw [KEY_LEN]byte) (DeviceState, bool) {
+	var (
+		found  DeviceState
+		exists bool
+	)
+	devices.forEach(func(devState *DeviceState) bool {
+		if devState.Status != DEVICE_REVOKED && devState.ScanData.SPubGW == sPubGw {
+			found, exists = *devState, true
+			return false
+		}
+		return true
+	})
+	return found, exists
+}
+
+// Answers a repeated signup of the device's key with the device's ID. Returns false if the signup was rejected. NOTE: The device keeps its keys
+// until the gateway proves the new ones with a pairing dummy message, see completeRepairing. Otherwise anyone knowing the public key could cut
+// the device off by signing up again
+func repairDevice(cfg *Config, devices *DeviceRegistry, devState DeviceState, result HandshakeResult) bool {
+	signupReq, scan := result.SignupReq, result.Scan
+
+	// (1) A key of a device of another type is not a re-pairing
+	if signupReq.DevType != devState.Type {
+		fmt.Println("WARNING, scan: Signup of device type", cfg.DeviceTypes.name(signupReq.DevType), "with the key of device", devState.Id, "of type", cfg.DeviceTypes.name(devState.Type), "==> Rejected")
+		cfg.Audit.record(AUDIT_SIGNUP_REJECTED, auditDevice(devState.Id), sourceOf(signupReq.Conn, signupReq.ConnId), "device type "+cfg.DeviceTypes.name(signupReq.DevType)+" differs from the device's")
+		_, err := signupReq.Conn.Write(createSignupReject(SIGNUP_REJECT_TYPE_MISMATCH))
+		checkSuccessString("scan, sending Signup Rejection", err)
+		return false
+	}
+
+	// (2) Keep the new keys aside, replacing those of an earlier repeated signup
+	repairing := &RepairingState{scan: scan, sessKeys: result.Sesskeys}
+	if !devices.update(devState.Id, func(devState *DeviceState) { devState.Repairing = repairing }) {
+		return false
+	}
+	fmt.Println("INFO, scan: Repeated signup of", scan.name(), "==> Re-pairing device", devState.Id)
+
+	// (3) Send the signup response with the existing ID
+	respMsg, err := createSignupResp(devState.Id, result.XP, signupReq.EPubGw[:], scan.Psk[:])
+	if !checkSuccessString("scan, creating Signup Response", err) {
+		return false
+	}
+	_, err = signupReq.Conn.Write(respMsg)
+	checkSuccessString("scan, sending Signup Response", err)
+	return true
+}
+
+// Completes a re-pairing if the pairing dummy message is authentic under the keys of the repeated signup. The device then continues with the new
+// keys and fresh counters, keeping its ID, role, approval and status. Returns false if the message is not authentic under the new keys
+func (s *AuthShard) completeRepairing(devId uint32, devState *DeviceState, authReq AuthReq, logSeq uint64) bool {
+	repairing := devState.Repairing
+
+	// (1) Check the MAC tag as for a freshly signed up device, whose counters are 0 and whose randomness is all zeros
+	macInput := make([]byte, REB_CNT_LEN+REQ_CNT_LEN+ACCESS_TYPE_LEN+RANDOM_LEN)
+	binary.LittleEndian.PutUint32(macInput, authReq.RebCnt)
+	binary.LittleEndian.PutUint32(macInput[REB_CNT_LEN:], authReq.ReqCnt)
+	binary.LittleEndian.PutUint16(macInput[REB_CNT_LEN+REQ_CNT_LEN:], authReq.AccessType)
+
+	macer := hmac.New(sha256.New, repairing.sessKeys.K_gw_s)
+	macer.Write(macInput)
+	if subtle.ConstantTimeCompare(macer.Sum(nil), authReq.MacTag) != 1 {
+		return false
+	}
+
+	// (2) Replace the keys. NOTE: Fails if another repeated signup replaced the re-pairing meanwhile, the gateway then has to pair again
+	replaced := false
+	if !s.devices.commit(s.cfg.Store, devId, func(devState *DeviceState) {
+		if devState.Repairing != repairing {
+			return
+		}
+		devState.Sesskeys = repairing.sessKeys
+		devState.ScanData = repairing.scan
+		devState.rebCnt, devState.reqCnt = 0, 0
+		devState.LastRandomness = make([]byte, RANDOM_LEN)
+		devState.Paired = true
+		devState.Repairing = nil
+		if authReq.Conn != nil {
+			devState.Conn = authReq.Conn
+		}
+		replaced = true
+	}) || !replaced {
+		return false
+	}
+
+	fmt.Println("INFO, scan: Device", devId, "re-paired")
+	devState.Log.settle(logSeq, LOG_OUTCOME_PAIRED, REASON_NONE)
+	return true
+}
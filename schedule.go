@@ -0,0 +1,216 @@
+// Schedule and time-window based rules of the policy, evaluated against the arrival time of the request
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Effects of a schedule rule
+const (
+	SCHEDULE_DENY     = "deny"     // Deny while the window is active
+	SCHEDULE_ONLY     = "only"     // Deny while the window is NOT active
+	SCHEDULE_INTERVAL = "interval" // While the window is active, grant at most one request per minInterval
+)
+
+var WEEKDAY_NAMES map[string]time.Weekday = map[string]time.Weekday{
+	"Sun": time.Sunday,
+	"Mon": time.Monday,
+	"Tue": time.Tuesday,
+	"Wed": time.Wednesday,
+	"Thu": time.Thursday,
+	"Fri": time.Friday,
+	"Sat": time.Saturday,
+}
+
+// A schedule rule, e.g. "CONTROL_ACTUATOR_1 only between 07:00 and 22:00":
+//
+//	{ "accessTypes": ["CONTROL_ACTUATOR_1"], "timezone": "Europe/Zurich", "from": "07:00", "to": "22:00", "effect": "only" }
+//
+// or "SAMPLE_SENSOR_0 at most every 5 minutes at night, except on weekends":
+//
+//	{ "accessTypes": ["SAMPLE_SENSOR_0"], "weekdays": ["Mon", "Tue", "Wed", "Thu", "Fri"], "from": "22:00", "to": "07:00",
+//	  "effect": "interval", "minInterval": "5m" }
+//
+// A window with from > to wraps around midnight and belongs to the weekday it starts on. Without from and to, the window spans the whole day.
+// On holidays, i.e. the policy's holidays and the rule's own, the window is not active
+type ScheduleRule struct {
+	PolicyMatch
+	Timezone    string   `json:"timezone"` // IANA time zone name, empty ==> local time of the server
+	Weekdays    []string `json:"weekdays"` // Empty ==> every day
+	From        string   `json:"from"`     // HH:MM
+	To          string   `json:"to"`       // HH:MM
+	Holidays    []string `json:"holidays"` // YYYY-MM-DD
+	Effect      string   `json:"effect"`
+	MinInterval string   `json:"minInterval"` // Go duration, e.g. "5m". Only used by the interval effect
+
+	location    *time.Location
+	weekdayMask uint8 // Bit i is set if time.Weekday(i) is part of the schedule
+	from        int   // Minutes since midnight
+	to          int   // Minutes since midnight
+	holidays    map[string]bool
+	minInterval time.Duration
+}
+
+func parseDates(path string, dates []string) (map[string]bool, error) {
+	parsed := make(map[string]bool)
+	for _, date := range dates {
+		_, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			return nil, &InvalidPolicy{Path: path, Reason: "invalid date \"" + date + "\""}
+		}
+		parsed[date] = true
+	}
+	return parsed, nil
+}
+
+// Parses HH:MM into minutes since midnight
+func parseClock(path string, clock string) (int, error) {
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 {
+		return 0, &InvalidPolicy{Path: path, Reason: "invalid time of day \"" + clock + "\""}
+	}
+
+	hours, errHours := strconv.Atoi(parts[0])
+	minutes, errMinutes := strconv.Atoi(parts[1])
+	if errHours != nil || errMinutes != nil || hours < 0 || hours > 23 || minutes < 0 || minutes > 59 {
+		return 0, &InvalidPolicy{Path: path, Reason: "invalid time of day \"" + clock + "\""}
+	}
+
+	return hours*60 + minutes, nil
+}
+
+func (r *ScheduleRule) resolve(path string) error {
+	err := r.PolicyMatch.resolve(path)
+	if err != nil {
+		return err
+	}
+
+	// (1) Time zone. NOTE: time.LoadLocation("") would be UTC, not the local time of the server
+	r.location = time.Local
+	if r.Timezone != "" {
+		r.location, err = time.LoadLocation(r.Timezone)
+		if err != nil {
+			return &InvalidPolicy{Path: path, Reason: "invalid time zone \"" + r.Timezone + "\": " + err.Error()}
+		}
+	}
+
+	// (2) Weekdays
+	if len(r.Weekdays) == 0 {
+		r.weekdayMask = 0x7f
+	}
+	for _, name := range r.Weekdays {
+		weekday, exists := WEEKDAY_NAMES[name]
+		if !exists {
+			return &InvalidPolicy{Path: path, Reason: "invalid weekday \"" + name + "\""}
+		}
+		r.weekdayMask |= 1 << uint(weekday)
+	}
+
+	// (3) Window
+	if r.From != "" || r.To != "" {
+		r.from, err = parseClock(path, r.From)
+		if err != nil {
+			return err
+		}
+		r.to, err = parseClock(path, r.To)
+		if err != nil {
+			return err
+		}
+	}
+
+	// (4) Holidays
+	r.holidays, err = parseDates(path, r.Holidays)
+	if err != nil {
+		return err
+	}
+
+	// (5) Effect
+	switch r.Effect {
+	case SCHEDULE_DENY, SCHEDULE_ONLY:
+	case SCHEDULE_INTERVAL:
+		r.minInterval, err = time.ParseDuration(r.MinInterval)
+		if err != nil || r.minInterval <= 0 {
+			return &InvalidPolicy{Path: path, Reason: "invalid minInterval \"" + r.MinInterval + "\""}
+		}
+	default:
+		return &InvalidPolicy{Path: path, Reason: "unknown schedule effect \"" + r.Effect + "\""}
+	}
+
+	return nil
+}
+
+// Returns true if t lies within the rule's window
+func (r *ScheduleRule) active(t time.Time, holidays map[string]bool) bool {
+	local := t.In(r.location)
+	minutes := local.Hour()*60 + local.Minute()
+
+	// (1) Find the day the window containing t started on, if any
+	var start time.Time
+	switch {
+	case r.from == r.to:
+		// Whole day
+		start = local
+	case r.from < r.to:
+		if minutes < r.from || minutes >= r.to {
+			return false
+		}
+		start = local
+	default:
+		// Window wraps around midnight
+		if minutes >= r.from {
+			start = local
+		} else if minutes < r.to {
+			start = local.AddDate(0, 0, -1)
+		} else {
+			return false
+		}
+	}
+
+	// (2) Check that day against the weekday mask and the holidays
+	if r.weekdayMask&(1<<uint(start.Weekday())) == 0 {
+		return false
+	}
+
+	date := start.Format("2006-01-02")
+	return !holidays[date] && !r.holidays[date]
+}
+
+// Returns the decision and reason code of the schedules for a request arriving at the given time. Every matching schedule must grant the request
+func (p *PolicyEngine) checkSchedules(devState *DeviceState, accessType uint16, arrival time.Time) (uint8, uint8) {
+	if p == nil {
+		return DECISION_ALLOW, REASON_NONE
+	}
+
+	for i := range p.Schedules {
+		rule := &p.Schedules[i]
+		if !rule.matches(devState, accessType) {
+			continue
+		}
+
+		active := rule.active(arrival, p.holidays)
+
+		switch rule.Effect {
+		case SCHEDULE_DENY:
+			if active {
+				return DECISION_DENY, REASON_SCHEDULE_WINDOW
+			}
+		case SCHEDULE_ONLY:
+			if !active {
+				return DECISION_DENY, REASON_SCHEDULE_WINDOW
+			}
+		case SCHEDULE_INTERVAL:
+			if !active {
+				continue
+			}
+			// NOTE: The request being decided is not granted yet. Grants pushed out of memory or made before a restart count as well
+			last, exists := devState.Log.lastGranted(accessType)
+			if exists && arrival.Sub(last) < rule.minInterval {
+				return DECISION_DENY, REASON_SCHEDULE_INTERVAL
+			}
+		}
+	}
+
+	return DECISION_ALLOW, REASON_NONE
+}
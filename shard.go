@@ -0,0 +1,521 @@
+// Shards processing the authentication requests, owner decisions and delegation requests of disjoint sets of devices in parallel.
+// Every device belongs to exactly one shard, which alone checks and consumes its counters, such that its requests are handled in arrival order
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const SHARD_QUEUE_LEN = 1000 // Capacity of each channel of a shard
+
+// Decision of the home owner device on a request parked by another shard
+type ShardDecision struct {
+	Ticket   uint32
+	Decision uint8
+}
+
+type AuthShard struct {
+	index   int
+	group   *AuthShards
+	cfg     *Config
+	devices *DeviceRegistry
+	owner   *HomeOwner
+
+	authChan          chan AuthReq
+	ownerDecisionChan chan OwnerDecision // Messages of the home owner device, if it belongs to this shard
+	delegationChan    chan DelegationReq // Delegation requests of the home owner device, if it belongs to this shard
+	decisionChan      chan ShardDecision // Decisions on the requests parked by this shard, forwarded by the home owner device's shard
+	leaseChan         chan QueuedRequest // Requests of this shard's devices which were handed the lease they waited for
+	timeoutChan       chan uint32        // Tickets of parked requests whose timeout expired
+
+	parked     ParkedRequests
+	nextTicket uint32          // Tickets of shard i are i, i + N, i + 2N, ... such that the ticket tells the shard
+	waiting    map[uint32]bool // Devices with a request parked or waiting for a lease
+}
+
+type AuthShards struct {
+	shards    []*AuthShard
+	lifecycle chan<- LifecycleCmd // Removals of devices, which the processor applies like those issued on the console
+}
+
+// Creates n shards and starts their goroutines. n < 1 ==> One shard
+func startAuthShards(n int, cfg *Config, devices *DeviceRegistry, owner *HomeOwner, lifecycle chan<- LifecycleCmd) *AuthShards {
+	if n < 1 {
+		n = 1
+	}
+
+	group := &AuthShards{shards: make([]*AuthShard, n), lifecycle: lifecycle}
+	for i := range group.shards {
+		group.shards[i] = &AuthShard{
+			index:             i,
+			group:             group,
+			cfg:               cfg,
+			devices:           devices,
+			owner:             owner,
+			authChan:          make(chan AuthReq, SHARD_QUEUE_LEN),
+			ownerDecisionChan: make(chan OwnerDecision, SHARD_QUEUE_LEN),
+			delegationChan:    make(chan DelegationReq, SHARD_QUEUE_LEN),
+			decisionChan:      make(chan ShardDecision, SHARD_QUEUE_LEN),
+			leaseChan:         make(chan QueuedRequest, SHARD_QUEUE_LEN),
+			timeoutChan:       make(chan uint32, SHARD_QUEUE_LEN),
+			parked:            make(ParkedRequests),
+			nextTicket:        uint32(i),
+			waiting:           make(map[uint32]bool),
+		}
+	}
+	for _, shard := range group.shards {
+		go shard.run()
+	}
+
+	fmt.Println("INFO, shard: Started", n, "authentication shards")
+	return group
+}
+
+// Returns the shard owning the device
+func (g *AuthShards) of(devId uint32) *AuthShard {
+	return g.shards[devId%uint32(len(g.shards))]
+}
+
+// Returns the shard which parked the request with the ticket
+func (g *AuthShards) ofTicket(ticket uint32) *AuthShard {
+	return g.shards[ticket%uint32(len(g.shards))]
+}
+
+// Event loop of the shard
+func (s *AuthShard) run() {
+	for {
+		select {
+
+		case authReq := <-s.authChan:
+			s.handleAuthReq(authReq)
+
+		case ownerDecision := <-s.ownerDecisionChan:
+			s.handleOwnerDecision(ownerDecision)
+
+		case delegationReq := <-s.delegationChan:
+			s.handleDelegationReq(delegationReq)
+
+		case decision := <-s.decisionChan:
+			s.decide(decision)
+
+		case next := <-s.leaseChan:
+			s.respondAuth(next.AuthReq.DevId, next.AuthReq, next.LogSeq, DECISION_ALLOW, REASON_LEASE_QUEUED)
+
+		case ticket := <-s.timeoutChan:
+
+			// The home owner device did not decide in time ==> Apply the default decision
+			parkedReq, exists := s.parked.take(ticket)
+			if !exists {
+				// Case: Already decided by the home owner device
+				continue
+			}
+
+			fmt.Println("INFO, approval: Ticket", ticket, "of device", parkedReq.DevId, "timed out ==> Default decision", s.cfg.ApprovalDefault)
+			if s.cfg.ApprovalDefault == DECISION_DENY {
+				s.refundRateLimit(parkedReq.AuthReq, parkedReq.Delegation, parkedReq.ParkedAt)
+			}
+			s.leaseAndRespond(parkedReq.DevId, parkedReq.AuthReq, parkedReq.LogSeq, parkedReq.Delegation, s.cfg.ApprovalDefault, REASON_OWNER_TIMEOUT)
+		}
+	}
+}
+
+// Checks an authentication request of one of the shard's devices for freshness and authenticity, authorizes it and answers it
+func (s *AuthShard) handleAuthReq(authReq AuthReq) {
+
+	fmt.Println("DEBUG: Received autReq:", authReq)
+
+	var devId uint32 = authReq.DevId
+
+	// (1) Check if device ID exists
+	devState, exists := s.devices.get(devId)
+	if !exists {
+		s.cfg.Audit.record(AUDIT_UNKNOWN_DEVICE, auditDevice(devId), sourceOf(authReq.Conn, authReq.ConnId), "authentication request")
+		return
+	}
+
+	// (2) Append to log
+
+	//(2.1) Create new log entry. Its outcome is recorded once known, such that forged and accepted requests can be told apart
+	logEntry := LogEntry{ArrivalTime: time.Now(), DevId: devId, Paired: devState.Paired, AuthReq: authReq, ConnId: authReq.ConnId}
+	if authReq.Conn != nil {
+		logEntry.RemoteAddr = authReq.Conn.RemoteAddr().String()
+	}
+
+	// (2.2) Append log entry to the device's log
+	logSeq := devState.Log.append(logEntry)
+
+	// (2.3) Revoked devices hold no keys ==> Dropped before any MAC computation
+	if devState.Status == DEVICE_REVOKED {
+		fmt.Println("WARNING, shard, authReq: Device", devId, "is revoked ==> Dropped")
+		devState.Log.settle(logSeq, LOG_OUTCOME_REVOKED, REASON_NONE)
+		s.cfg.Audit.record(AUDIT_REVOKED_DEVICE, auditDevice(devId), sourceOf(authReq.Conn, authReq.ConnId), "authentication request")
+		return
+	}
+
+	// (2.4) A pairing dummy message authentic under the keys of a repeated signup completes the re-pairing, see scan.go
+	if devState.Repairing != nil && authReq.AccessType == DUMMY_REQUEST && s.completeRepairing(devId, &devState, authReq, logSeq) {
+		return
+	}
+
+	// (3) Check request for freshness and authenticity
+	// (3.1) Get Gateway->Server key
+	chalKey := devState.Sesskeys.K_gw_s
+
+	// (3.2) Create HMAC functor to check the request
+	chalHmacer := hmac.New(sha256.New, chalKey)
+
+	// (3.3) Check if challenge is fresh and authentic
+
+	// (3.3.1) Check if counters are at least as large as current counters. This creates a sidechannel where attacker can learn expected counter value
+	if authReq.RebCnt < devState.rebCnt {
+		// CASE: Request before a previous reboot of the gateway ==> old request
+		fmt.Println("WARNING, shard, authReq: Authentication Request has old rebCnt")
+		s.cfg.Audit.record(AUDIT_STALE_COUNTER, auditDevice(devId), sourceOf(authReq.Conn, authReq.ConnId), fmt.Sprintf("authentication request with rebCnt %v, expected at least %v", authReq.RebCnt, devState.rebCnt))
+		devState.Log.settle(logSeq, LOG_OUTCOME_STALE_COUNTER, REASON_NONE)
+		reportAnomalies(s.cfg.Audit, s.cfg.Anomalies.observeFailure(devId, ANOMALY_STALE_COUNTER, logEntry.ArrivalTime), s.owner.state(s.devices))
+		return
+	}
+
+	if authReq.ReqCnt < devState.reqCnt {
+		// CASE: Request's boot counter is fresh but request counter is less than the server's counter ==> old request
+		fmt.Println("WARNING, shard, authReq: Authentication Request has old reqCnt")
+		s.cfg.Audit.record(AUDIT_STALE_COUNTER, auditDevice(devId), sourceOf(authReq.Conn, authReq.ConnId), fmt.Sprintf("authentication request with reqCnt %v, expected at least %v", authReq.ReqCnt, devState.reqCnt))
+		devState.Log.settle(logSeq, LOG_OUTCOME_STALE_COUNTER, REASON_NONE)
+		reportAnomalies(s.cfg.Audit, s.cfg.Anomalies.observeFailure(devId, ANOMALY_STALE_COUNTER, logEntry.ArrivalTime), s.owner.state(s.devices))
+
+		return
+	}
+
+	// (3.3.2) Create slice to MAC over
+	macInput := make([]byte, REB_CNT_LEN+REQ_CNT_LEN+ACCESS_TYPE_LEN+RANDOM_LEN)
+	// WARNING: If REB_CNT_LEN != 4, the following fails because it copies 32 bits (4 bytes)!
+	binary.LittleEndian.PutUint32(macInput, authReq.RebCnt)
+	binary.LittleEndian.PutUint32(macInput[REB_CNT_LEN:], authReq.ReqCnt)
+	binary.LittleEndian.PutUint16(macInput[REB_CNT_LEN+REQ_CNT_LEN:], authReq.AccessType)
+	copy(macInput[REB_CNT_LEN+REQ_CNT_LEN+ACCESS_TYPE_LEN:], devState.LastRandomness)
+
+	// (3.3.3) Check MAC-tag
+	_, err := chalHmacer.Write(macInput)
+	if !checkSuccessString("shard, authReq, chalHmac digesting message", err) {
+		return
+	}
+
+	// (3.3.4) Compute digest
+	macTag := chalHmacer.Sum(nil)
+
+	// (3.3.5) Compare with included tag
+	macEquals := subtle.ConstantTimeCompare(macTag, authReq.MacTag)
+	if macEquals != 1 {
+		// 1§ : MAC Tags disagree
+		fmt.Println("WARNING, shard, authReq: Authentication Request has bad MAC Tag")
+		s.cfg.Audit.record(AUDIT_BAD_MAC, auditDevice(devId), sourceOf(authReq.Conn, authReq.ConnId), fmt.Sprint("authentication request of access type ", authReq.AccessType))
+		devState.Log.settle(logSeq, LOG_OUTCOME_BAD_MAC, REASON_NONE)
+		reportAnomalies(s.cfg.Audit, s.cfg.Anomalies.observeFailure(devId, ANOMALY_BAD_MAC, logEntry.ArrivalTime), s.owner.state(s.devices))
+		return
+	}
+
+	// If we reach here, the request is fresh and authentic
+
+	// Answer on the connection the request arrived on, e.g. after the gateway reconnected or the server restarted
+	if authReq.Conn != nil && devState.Conn != authReq.Conn {
+		devState.Conn = authReq.Conn
+		s.devices.update(devId, func(devState *DeviceState) { devState.Conn = authReq.Conn })
+	}
+
+	// NOTE: While a request of the device is parked or waits for a lease, its LastRandomness does not change. Any further request, including a replay
+	//		 of the waiting one, is dropped until the waiting one is answered
+	if s.waiting[devId] {
+		fmt.Println("WARNING, shard, authReq: Device", devId, "already has a waiting request ==> Dropped")
+		devState.Log.settle(logSeq, LOG_OUTCOME_DROPPED, REASON_NONE)
+		return
+	}
+
+	// NOTE: If the device had not been paired previously, we here set the flag as paired because the device has proven that it knows the key,
+	//		 so we know the device is fully paired!
+
+	if authReq.AccessType == DUMMY_REQUEST {
+		// NOTE: The DUMMY_REQUEST does NOT change the randomness field stored in the device state.
+		//       That is because no response (holding randomness) is ever created by the server!
+		if !s.devices.commit(s.cfg.Store, devId, func(devState *DeviceState) { devState.Paired = true }) {
+			return
+		}
+		fmt.Println("DEBUG, shard, authReq: Received authentic pairing dummy message ==> Now (re)paired")
+		devState.Log.settle(logSeq, LOG_OUTCOME_PAIRED, REASON_NONE)
+
+		// First device to pair ==> Always the home owner device. Once a home owner device existed, only the console designates the next one
+		s.owner.designate(s.cfg.Store, s.devices, devId, true)
+		return
+	}
+
+	fmt.Println("DEBUG, shard, authReq: Received fresh and authentic authentication request from device:", devId)
+
+	// (3.4) Compare the request with what the device usually does
+	reportAnomalies(s.cfg.Audit, s.cfg.Anomalies.observe(devId, authReq.AccessType, logEntry.ArrivalTime), s.owner.state(s.devices))
+
+	// (4) Check whether the device is authorized for the access type
+	decision, reason, delegation := authorize(s.cfg, s.devices, &devState, authReq.AccessType, logEntry.ArrivalTime)
+	if decision == DECISION_DENY {
+		fmt.Println("INFO, shard, authReq: Denied access type", authReq.AccessType, "for device", devId, "of type", s.cfg.DeviceTypes.name(devState.Type), "with reason", reason)
+	}
+
+	// (4.1) Requests using a delegation use the grantor's access type ==> Its catalogue entry counts
+	catalogueType := devState.Type
+	if delegation != nil {
+		devState.Log.update(logSeq, func(entry *LogEntry) { entry.Delegation = delegation })
+		grantorState, _ := s.devices.get(delegation.Grantor)
+		catalogueType = grantorState.Type
+		fmt.Println("INFO, shard, authReq: Device", devId, "uses access type", authReq.AccessType, "of device", delegation.Grantor, "by delegation", delegation.Id)
+	}
+
+	// (4.2) Write requests granted so far may additionally need the home owner device's approval. The home owner device needs nobody's approval
+	accessTypeDef, _ := s.cfg.DeviceTypes.accessType(catalogueType, authReq.AccessType)
+	if decision == DECISION_ALLOW && s.cfg.ActuatorApproval && accessTypeDef != nil && accessTypeDef.Category == CATEGORY_WRITE && !s.owner.is(devId) {
+		if ownerState := s.owner.state(s.devices); ownerState != nil {
+			s.parked.park(s.nextTicket, authReq, logSeq, delegation, ownerState, s.cfg.ApprovalTimeout, s.timeoutChan)
+			s.waiting[devId] = true
+			s.nextTicket += uint32(len(s.group.shards))
+			return
+		}
+
+		decision, reason = s.cfg.ApprovalDefault, REASON_OWNER_UNAVAILABLE
+		if decision == DECISION_DENY {
+			s.refundRateLimit(authReq, delegation, logEntry.ArrivalTime)
+		}
+		fmt.Println("INFO, shard, authReq: No home owner device to approve access type", authReq.AccessType, "for device", devId, "==> Default decision", decision)
+	}
+
+	// (5) Send authentic response holding the decision, once the lease on the actuator is acquired
+	s.leaseAndRespond(devId, authReq, logSeq, delegation, decision, reason)
+}
+
+// Applies a decision of the home owner device. The home owner device belongs to this shard
+func (s *AuthShard) handleOwnerDecision(ownerDecision OwnerDecision) {
+
+	fmt.Println("DEBUG: Received ownerDecision:", ownerDecision)
+
+	// (1) Check that the decision is sent by the home owner device, which is neither suspended nor revoked
+	ownerState, isOwner := s.activeOwner(ownerDecision.DevId, ownerDecision.Source, fmt.Sprint("owner decision on ticket ", ownerDecision.Ticket))
+	if !isOwner {
+		return
+	}
+
+	// (2) Check the decision for freshness and authenticity
+	if !verifyOwnerDecision(s.cfg.Audit, &ownerState, ownerDecision) {
+		return
+	}
+
+	// (3) Consume the counters
+	if !s.devices.commit(s.cfg.Store, ownerDecision.DevId, func(ownerState *DeviceState) {
+		ownerState.rebCnt = ownerDecision.RebCnt
+		ownerState.reqCnt = ownerDecision.ReqCnt
+	}) {
+		return
+	}
+
+	switch ownerDecision.Kind {
+	case OWNER_KIND_SIGNUP:
+		// (4) Apply the decision to the device awaiting approval. NOTE: Only Pending changes, which the device's shard merely reads
+		devState, exists := s.devices.get(ownerDecision.Ticket)
+		if !exists || !devState.Pending {
+			fmt.Println("WARNING, shard, ownerDecision: Device", ownerDecision.Ticket, "is not awaiting approval")
+			return
+		}
+
+		if ownerDecision.Decision == DECISION_ALLOW {
+			if !s.devices.commit(s.cfg.Store, ownerDecision.Ticket, func(devState *DeviceState) { devState.Pending = false }) {
+				return
+			}
+			fmt.Println("INFO, shard, ownerDecision: Home owner device approved device", ownerDecision.Ticket)
+		} else {
+			// Deleted by the processor as if on the console, which quarantines the ID and purges the log and the statistics.
+			// NOTE: Sent from a goroutine, as the processor may be waiting for room in this shard's queue
+			cmd := LifecycleCmd{Op: LIFECYCLE_DELETE, DevId: ownerDecision.Ticket}
+			go func() { s.group.lifecycle <- cmd }()
+			fmt.Println("INFO, shard, ownerDecision: Home owner device rejected device", ownerDecision.Ticket, "==> Deleting it")
+		}
+
+	case OWNER_KIND_ACCESS:
+		// (4) Answer the parked request with the decision, in the shard which parked it
+		decision := ShardDecision{Ticket: ownerDecision.Ticket, Decision: ownerDecision.Decision}
+		target := s.group.ofTicket(decision.Ticket)
+		if target == s {
+			s.decide(decision)
+		} else {
+			target.decisionChan <- decision
+		}
+	}
+}
+
+// Returns the state of the sender of an owner message. The flag is unset, and the message recorded as audit event, if the sender is not the
+// home owner device or is suspended or revoked
+func (s *AuthShard) activeOwner(devId uint32, source AuditSource, what string) (DeviceState, bool) {
+	ownerState, exists := s.devices.get(devId)
+	if !exists || !s.owner.is(devId) {
+		fmt.Println("WARNING, shard, owner message:", what, "sent by device", devId, "which is not the home owner device")
+		s.cfg.Audit.record(AUDIT_NOT_OWNER, auditDevice(devId), source, what)
+		return DeviceState{}, false
+	}
+
+	switch ownerState.Status {
+	case DEVICE_SUSPENDED:
+		fmt.Println("WARNING, shard, owner message:", what, "sent by the suspended home owner device", devId, "==> Ignored")
+		s.cfg.Audit.record(AUDIT_NOT_OWNER, auditDevice(devId), source, what+" while suspended")
+		return DeviceState{}, false
+	case DEVICE_REVOKED:
+		fmt.Println("WARNING, shard, owner message:", what, "sent by the revoked device", devId, "==> Ignored")
+		s.cfg.Audit.record(AUDIT_REVOKED_DEVICE, auditDevice(devId), source, what)
+		return DeviceState{}, false
+	}
+	return ownerState, true
+}
+
+// Answers the request parked under the ticket with the home owner device's decision
+func (s *AuthShard) decide(decision ShardDecision) {
+	parkedReq, exists := s.parked.take(decision.Ticket)
+	if !exists {
+		fmt.Println("WARNING, shard, ownerDecision: Ticket", decision.Ticket, "is not parked (anymore)")
+		return
+	}
+
+	fmt.Println("INFO, approval: Home owner device decided", decision.Decision, "on ticket", parkedReq.Ticket, "of device", parkedReq.DevId, "after", time.Since(parkedReq.ParkedAt))
+	if decision.Decision == DECISION_DENY {
+		s.refundRateLimit(parkedReq.AuthReq, parkedReq.Delegation, parkedReq.ParkedAt)
+	}
+	s.leaseAndRespond(parkedReq.DevId, parkedReq.AuthReq, parkedReq.LogSeq, parkedReq.Delegation, decision.Decision, REASON_OWNER_DECISION)
+}
+
+// Issues or revokes a delegation requested by the home owner device. The home owner device belongs to this shard
+func (s *AuthShard) handleDelegationReq(delegationReq DelegationReq) {
+
+	fmt.Println("DEBUG: Received delegationReq:", delegationReq)
+
+	// (1) Check that the delegation is sent by the home owner device, which is neither suspended nor revoked
+	ownerState, isOwner := s.activeOwner(delegationReq.DevId, delegationReq.Source, fmt.Sprint("delegation from device ", delegationReq.Grantor, " to device ", delegationReq.Grantee))
+	if !isOwner {
+		return
+	}
+
+	// (2) Check the delegation for freshness and authenticity
+	if !verifyDelegationReq(s.cfg.Audit, &ownerState, delegationReq) {
+		return
+	}
+
+	// (3) Consume the counters
+	if !s.devices.commit(s.cfg.Store, delegationReq.DevId, func(ownerState *DeviceState) {
+		ownerState.rebCnt = delegationReq.RebCnt
+		ownerState.reqCnt = delegationReq.ReqCnt
+	}) {
+		return
+	}
+
+	// (4) Issue or revoke the delegation
+	applyDelegation(s.cfg, s.devices, delegationReq, fmt.Sprint("home owner device ", delegationReq.DevId))
+}
+
+// Acquires the lease a granted request needs before sending the response. A request waiting for the lease is answered once it gets it.
+// The lease is the one of the actuator, i.e. of the grantor for a request using a delegation
+func (s *AuthShard) leaseAndRespond(devId uint32, authReq AuthReq, logSeq uint64, delegation *Delegation, decision uint8, reason uint8) {
+	actuatorId := devId
+	if delegation != nil {
+		actuatorId = delegation.Grantor
+	}
+	actuatorState, exists := s.devices.get(actuatorId)
+
+	if decision == DECISION_ALLOW && exists {
+		outcome, name := s.cfg.Leases.acquire(&actuatorState, authReq, logSeq, time.Now())
+
+		switch outcome {
+		case LEASE_BUSY:
+			fmt.Println("INFO, shard, lease: Lease", name, "is held by another device ==> Denied access type", authReq.AccessType, "for device", devId)
+			decision, reason = DECISION_DENY, REASON_LEASE_HELD
+			s.refundRateLimit(authReq, delegation, time.Now())
+		case LEASE_QUEUED:
+			fmt.Println("INFO, shard, lease: Lease", name, "is held by another device ==> Access type", authReq.AccessType, "of device", devId, "waits for it")
+			s.waiting[devId] = true
+			return
+		}
+	}
+
+	s.respondAuth(devId, authReq, logSeq, decision, reason)
+}
+
+// Gives back what the rate limiter counted for a request which authorize granted but a later step denied. The request counted against the
+// actuator, i.e. the grantor for a request using a delegation
+func (s *AuthShard) refundRateLimit(authReq AuthReq, delegation *Delegation, admitted time.Time) {
+	actuatorId := authReq.DevId
+	if delegation != nil {
+		actuatorId = delegation.Grantor
+	}
+	s.cfg.RateLimiter.refund(actuatorId, authReq.AccessType, admitted)
+}
+
+// Sends the authentication response for a fresh and authentic request, consumes its counters and records the decision in its log entry
+func (s *AuthShard) respondAuth(devId uint32, authReq AuthReq, logSeq uint64, decision uint8, reason uint8) {
+
+	// (1) Get the device's state. It may have been removed while the request was parked or waited for a lease
+	delete(s.waiting, devId)
+	devState, exists := s.devices.get(devId)
+	if !exists {
+		fmt.Println("WARNING, shard, respondAuth: Device", devId, "no longer exists ==> No response sent")
+		return
+	}
+	if devState.Status == DEVICE_REVOKED {
+		fmt.Println("WARNING, shard, respondAuth: Device", devId, "was revoked ==> No response sent")
+		devState.Log.settle(logSeq, LOG_OUTCOME_UNANSWERED, reason)
+		return
+	}
+
+	// (2) Create authentic response holding the decision
+	authMsg, sRandom, err := createAuthResp(decision, reason, authReq.MacTag, devState.Sesskeys.K_s_gw)
+	if !checkSuccessString("shard, respondAuth, creating authentication response", err) {
+		devState.Log.settle(logSeq, LOG_OUTCOME_UNANSWERED, reason)
+		return
+	}
+
+	// (3) Update the server's counters AND LastRandomness and record the decision in the registry.
+	//	   NOTE: This is done for denied requests as well, the gateway consumes the randomness of every response it receives
+	//	   NOTE: Counters and randomness must be durable before the gateway sees the response, else a restart would accept a replay of the request
+	committed := s.devices.commit(s.cfg.Store, devId, func(devState *DeviceState) {
+		devState.rebCnt = authReq.RebCnt
+		devState.reqCnt = authReq.ReqCnt
+		devState.LastRandomness = sRandom
+	})
+	if !committed {
+		fmt.Println("WARNING, shard, respondAuth: Could not persist device", devId, "==> No response sent")
+		devState.Log.settle(logSeq, LOG_OUTCOME_UNANSWERED, reason)
+		return
+	}
+
+	// (3.1) Record the decision and a hash of the randomness in the request's log entry
+	outcome := uint8(LOG_OUTCOME_DENIED)
+	if decision == DECISION_ALLOW {
+		outcome = LOG_OUTCOME_GRANTED
+	}
+	randomnessHash := sha256.Sum256(sRandom)
+	var entry LogEntry
+	logged := devState.Log.update(logSeq, func(logEntry *LogEntry) {
+		logEntry.settle(outcome, reason)
+		logEntry.RandomnessHash = randomnessHash[:]
+		entry = *logEntry
+	})
+	if !logged {
+		fmt.Println("WARNING, shard, respondAuth: Log entry", logSeq, "of device", devId, "was spilled before the response ==> Decision not logged")
+	}
+
+	if entry.Granted && entry.Delegation != nil {
+		recordDelegatedUse(s.devices, entry)
+	}
+
+	// (4) Send message over connection
+	n, err := devState.Conn.Write(authMsg)
+	if !checkSuccessString("shard, respondAuth, sending message", err) {
+		// If partial message was sent, print what was sent
+		fmt.Println("ERROR /2: n =", n, "bytes were written, which means message: \""+hex.EncodeToString(authMsg[:n])+"\"")
+	}
+}
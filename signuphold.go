@@ -0,0 +1,153 @@
+// Signups which arrive before the scan of their static public key. They are held until the scan arrives, which completes them, or until their
+// hold expires, in which case the gateway is told that it is not provisioned
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const HELD_SIGNUPS_MAX = 1000 // Further signups without scan are rejected right away, such that unscanned gateways cannot pile up connections
+
+type HeldSignup struct {
+	SignupReq SignupReq
+	Arrival   time.Time
+	Expires   time.Time
+
+	generation uint64 // Distinguishes the expiry timers of signups of the same key
+}
+
+type HeldSignupExpiry struct {
+	SPubGW     [KEY_LEN]byte
+	Generation uint64
+}
+
+// NOTE: Holding and taking is done by the processor only, the lock guards the listing on the console
+type SignupHold struct {
+	mu             sync.Mutex
+	period         time.Duration
+	held           map[[KEY_LEN]byte]HeldSignup
+	nextGeneration uint64
+
+	Expired chan HeldSignupExpiry // Reports expired holds to the processor
+}
+
+// Creates the hold. period <= 0 ==> Signups without scan are rejected right away, nil is returned
+func newSignupHold(period time.Duration) *SignupHold {
+	if period <= 0 {
+		return nil
+	}
+	return &SignupHold{period: period, held: make(map[[KEY_LEN]byte]HeldSignup), Expired: make(chan HeldSignupExpiry, HELD_SIGNUPS_MAX)}
+}
+
+// Holds the signup until the scan of its key arrives and arms the expiry timer. A signup of the same key held before is replaced and returned,
+// such that it can be rejected. Returns false if the signup is not held, i.e. the hold is disabled or full
+func (h *SignupHold) hold(signupReq SignupReq, now time.Time) (*HeldSignup, bool) {
+	if h == nil {
+		return nil, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var replaced *HeldSignup
+	if previous, exists := h.held[signupReq.SPubGW]; exists {
+		replaced = &previous
+	} else if len(h.held) >= HELD_SIGNUPS_MAX {
+		return nil, false
+	}
+
+	generation := h.nextGeneration
+	h.nextGeneration += 1
+	h.held[signupReq.SPubGW] = HeldSignup{SignupReq: signupReq, Arrival: now, Expires: now.Add(h.period), generation: generation}
+
+	sPubGw := signupReq.SPubGW
+	time.AfterFunc(h.period, func() {
+		h.Expired <- HeldSignupExpiry{SPubGW: sPubGw, Generation: generation}
+	})
+	return replaced, true
+}
+
+// Removes and returns the signup held for the key
+func (h *SignupHold) take(sPubGw [KEY_LEN]byte) (HeldSignup, bool) {
+	if h == nil {
+		return HeldSignup{}, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	held, exists := h.held[sPubGw]
+	delete(h.held, sPubGw)
+	return held, exists
+}
+
+// Removes and returns the signup whose hold expired. Returns false if it was taken or replaced meanwhile
+func (h *SignupHold) expire(expiry HeldSignupExpiry) (HeldSignup, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	held, exists := h.held[expiry.SPubGW]
+	if !exists || held.generation != expiry.Generation {
+		return HeldSignup{}, false
+	}
+	delete(h.held, expiry.SPubGW)
+	return held, true
+}
+
+func (h *SignupHold) printHeld(deviceTypes *DeviceTypeRegistry) {
+	if h == nil {
+		fmt.Println("CONSOLE: Signups without scan are not held")
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	held := make([]HeldSignup, 0, len(h.held))
+	for _, signup := range h.held {
+		held = append(held, signup)
+	}
+	sort.Slice(held, func(i, j int) bool { return held[i].Arrival.Before(held[j].Arrival) })
+
+	fmt.Println("CONSOLE: - - - - - Signups awaiting their scan - - - - -")
+	for _, signup := range held {
+		signupReq := signup.SignupReq
+		remoteAddr := ""
+		if signupReq.Conn != nil {
+			remoteAddr = signupReq.Conn.RemoteAddr().String()
+		}
+		fmt.Printf("Static public key: %v, Device type: %v, From: %v, Waiting: %v, Expires in: %v\n", hex.EncodeToString(signupReq.SPubGW[:]), deviceTypes.name(signupReq.DevType), remoteAddr,
+			time.Since(signup.Arrival).Round(time.Second), time.Until(signup.Expires).Round(time.Second))
+	}
+}
+
+// Adds the scan and continues a signup which arrived before it
+func scanArrived(cfg *Config, scans Scans, handshakes *HandshakePool, scan Scan) {
+	now := time.Now()
+	scans.add(cfg.Store, scan, now)
+
+	held, exists := cfg.HeldSignups.take(scan.SPubGW)
+	if !exists {
+		return
+	}
+
+	scan, scanExists := scans.lookup(cfg.Store, scan.SPubGW, now)
+	if !scanExists {
+		rejectUnprovisioned(cfg, held.SignupReq, "scan expired before it was processed")
+		return
+	}
+	fmt.Println("INFO, signup hold: Scan", scan.name(), "arrived", now.Sub(held.Arrival).Round(time.Millisecond), "after its signup ==> Continuing the signup")
+	submitHandshake(cfg, handshakes, held.SignupReq, scan)
+}
+
+// Tells the gateway that its key was not scanned
+func rejectUnprovisioned(cfg *Config, signupReq SignupReq, details string) {
+	fmt.Println("WARNING, signup hold: No scan of static public key", hex.EncodeToString(signupReq.SPubGW[:]), "==> Rejected signup,", details)
+	cfg.Audit.record(AUDIT_SIGNUP_WITHOUT_SCAN, nil, sourceOf(signupReq.Conn, signupReq.ConnId), "static public key "+hex.EncodeToString(signupReq.SPubGW[:])+", "+details)
+	_, err := signupReq.Conn.Write(createSignupReject(SIGNUP_REJECT_NOT_PROVISIONED))
+	checkSuccessString("signup hold, sending Signup Rejection", err)
+}
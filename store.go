@@ -0,0 +1,530 @@
+// File-backed store of the device registry, made of an append-only journal of state changes and periodic snapshots
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	STORE_SNAPSHOT_FILE = "snapshot.json"
+	STORE_JOURNAL_FILE  = "journal.jsonl"
+)
+
+// Journal record operations
+const (
+	RECORD_DEVICE     = "device"     // Creates or replaces the device
+	RECORD_DELETE     = "delete"     // Removes the device
+	RECORD_SCAN       = "scan"       // Adds the scan
+	RECORD_UNSCAN     = "unscan"     // Removes the scan
+	RECORD_QUARANTINE = "quarantine" // Quarantines the ID of a deleted device
+	RECORD_DELEGATE   = "delegate"   // Issues the delegation
+	RECORD_UNDELEGATE = "undelegate" // Removes the delegation
+)
+
+// Durable part of a DeviceState. Connections and logs are not persisted
+type PersistedDevice struct {
+	Id             uint32 `json:"id"`
+	Type           uint16 `json:"type"`
+	RebCnt         uint32 `json:"rebCnt"`
+	ReqCnt         uint32 `json:"reqCnt"`
+	CapURI         string `json:"capURI"`
+	LastRandomness []byte `json:"lastRandomness"`
+	K_gw_s         []byte `json:"kGwS"`
+	K_s_gw         []byte `json:"kSGw"`
+	Paired         bool   `json:"paired"`
+	Owner          bool   `json:"owner"`
+	Pending        bool   `json:"pending"`
+	Status         uint8  `json:"status,omitempty"`
+	ScanData       Scan   `json:"scan"`
+}
+
+// A single line of the journal
+type JournalRecord struct {
+	Op     string           `json:"op"`
+	Device *PersistedDevice `json:"device,omitempty"`
+	DevId  uint32           `json:"devId,omitempty"`
+	Scan   *Scan            `json:"scan,omitempty"`
+	Until  *time.Time       `json:"until,omitempty"` // End of the quarantine
+
+	Delegation *Delegation `json:"delegation,omitempty"`
+}
+
+// Content of the snapshot file
+type StoreSnapshot struct {
+	NextDevId  uint32               `json:"nextDevId"`
+	Devices    []PersistedDevice    `json:"devices"`
+	Scans      []Scan               `json:"scans"`
+	Quarantine map[uint32]time.Time `json:"quarantine,omitempty"`
+
+	NextDelegationId uint32       `json:"nextDelegationId,omitempty"`
+	Delegations      []Delegation `json:"delegations,omitempty"`
+}
+
+// Mirrors the durable state, such that snapshots can be taken without the processor's maps.
+// NOTE: The processor and every shard write to the store, mu serializes the appends. The sync of the journal is done outside of mu and covers
+// every record written before it (group commit), such that the shards do not wait for each other's syncs one by one
+type Store struct {
+	mu            sync.Mutex
+	dir           string
+	journal       *os.File
+	records       int // Journal records since the last snapshot
+	snapshotEvery int
+
+	written    uint64     // Records written to the journal since opening it
+	synced     uint64     // Records known to be on disk
+	failedUpTo uint64     // Records covered by a failed sync, their appends report the failure
+	syncing    bool       // A sync is in progress, later appends wait for it and sync afterwards
+	closed     bool       // Set on shutdown, later appends fail
+	syncDone   *sync.Cond // Signalled with mu after every sync
+
+	devices    map[uint32]PersistedDevice
+	scans      map[[KEY_LEN]byte]Scan
+	nextDevId  uint32               // Next candidate of the sequential ID allocation, see idalloc.go
+	quarantine map[uint32]time.Time // IDs of deleted devices and the end of their quarantine
+
+	delegations      map[uint32]Delegation
+	nextDelegationId uint32
+}
+
+func persistDevice(devState *DeviceState) PersistedDevice {
+	return PersistedDevice{
+		Id:             devState.Id,
+		Type:           devState.Type,
+		RebCnt:         devState.rebCnt,
+		ReqCnt:         devState.reqCnt,
+		CapURI:         devState.CapURI,
+		LastRandomness: devState.LastRandomness,
+		K_gw_s:         devState.Sesskeys.K_gw_s,
+		K_s_gw:         devState.Sesskeys.K_s_gw,
+		Paired:         devState.Paired,
+		Owner:          devState.Owner,
+		Pending:        devState.Pending,
+		Status:         devState.Status,
+		ScanData:       devState.ScanData,
+	}
+}
+
+func (d *PersistedDevice) restore() DeviceState {
+	return DeviceState{
+		Id:             d.Id,
+		Type:           d.Type,
+		rebCnt:         d.RebCnt,
+		reqCnt:         d.ReqCnt,
+		CapURI:         d.CapURI,
+		LastRandomness: d.LastRandomness,
+		Sesskeys:       Sessionkeys{K_gw_s: d.K_gw_s, K_s_gw: d.K_s_gw},
+		Paired:         d.Paired,
+		Owner:          d.Owner,
+		Pending:        d.Pending,
+		Status:         d.Status,
+		ScanData:       d.ScanData,
+	}
+}
+
+// Loads the snapshot and replays the journal of the directory, creating both if needed, and opens the journal for appending
+func openStore(dir string, snapshotEvery int) (*Store, error) {
+	s := &Store{dir: dir, snapshotEvery: snapshotEvery, devices: make(map[uint32]PersistedDevice), scans: make(map[[KEY_LEN]byte]Scan), quarantine: make(map[uint32]time.Time),
+		delegations: make(map[uint32]Delegation)}
+
+	s.syncDone = sync.NewCond(&s.mu)
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// (1) Load the snapshot, if any
+	raw, err := os.ReadFile(filepath.Join(dir, STORE_SNAPSHOT_FILE))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var snapshot StoreSnapshot
+		err = json.Unmarshal(raw, &snapshot)
+		if err != nil {
+			return nil, &InvalidStore{Path: filepath.Join(dir, STORE_SNAPSHOT_FILE), Reason: err.Error()}
+		}
+
+		s.nextDevId = snapshot.NextDevId
+		for _, device := range snapshot.Devices {
+			s.devices[device.Id] = device
+		}
+		for _, scan := range snapshot.Scans {
+			s.scans[scan.SPubGW] = scan
+		}
+		for devId, until := range snapshot.Quarantine {
+			s.quarantine[devId] = until
+		}
+		s.nextDelegationId = snapshot.NextDelegationId
+		for _, delegation := range snapshot.Delegations {
+			s.delegations[delegation.Id] = delegation
+		}
+	}
+
+	// (2) Replay the journal on top of it
+	s.journal, err = os.OpenFile(filepath.Join(dir, STORE_JOURNAL_FILE), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.replay()
+	if err != nil {
+		s.journal.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Applies every record of the journal. A torn last record, i.e. one whose write was interrupted by a crash, is cut off
+func (s *Store) replay() error {
+	path := filepath.Join(s.dir, STORE_JOURNAL_FILE)
+	reader := bufio.NewReader(s.journal)
+
+	var valid int64 // Length of the journal up to the end of the last complete record
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				fmt.Println("WARNING, store: Cutting off torn last record of", path)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var record JournalRecord
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			return &InvalidStore{Path: path, Reason: "record at offset " + fmt.Sprint(valid) + ": " + err.Error()}
+		}
+		s.apply(record)
+
+		valid += int64(len(line))
+		s.records += 1
+	}
+
+	// Continue appending after the last complete record
+	err := s.journal.Truncate(valid)
+	if err != nil {
+		return err
+	}
+	_, err = s.journal.Seek(valid, io.SeekStart)
+	return err
+}
+
+func (s *Store) apply(record JournalRecord) {
+	switch record.Op {
+	case RECORD_DEVICE:
+		s.devices[record.Device.Id] = *record.Device
+		if record.Device.Id >= s.nextDevId {
+			s.nextDevId = record.Device.Id + 1
+		}
+	case RECORD_DELETE:
+		delete(s.devices, record.DevId)
+	case RECORD_SCAN:
+		s.scans[record.Scan.SPubGW] = *record.Scan
+	case RECORD_UNSCAN:
+		delete(s.scans, record.Scan.SPubGW)
+	case RECORD_QUARANTINE:
+		s.quarantine[record.DevId] = *record.Until
+	case RECORD_DELEGATE:
+		s.delegations[record.Delegation.Id] = *record.Delegation
+		if record.Delegation.Id >= s.nextDelegationId {
+			s.nextDelegationId = record.Delegation.Id + 1
+		}
+	case RECORD_UNDELEGATE:
+		delete(s.delegations, record.Delegation.Id)
+	}
+}
+
+// Fills the processor's maps with the stored state and returns the next unused device ID. A nil store restores nothing.
+// NOTE: Logs are not stored, the caller creates them
+func (s *Store) restore(devices *DeviceRegistry, scans Scans) uint32 {
+	if s == nil {
+		return 0
+	}
+
+	for _, device := range s.devices {
+		devices.add(device.restore())
+	}
+	for sPubGw, scan := range s.scans {
+		scans[sPubGw] = scan
+	}
+
+	fmt.Println("INFO, store: Restored", len(s.devices), "devices and", len(s.scans), "scans from", s.dir)
+	return s.nextDevId
+}
+
+// Appends the record to the journal and waits until it is on disk. Takes a snapshot every snapshotEvery records.
+// NOTE: The record is mirrored as soon as it is written. If the sync fails, the caller is told so and must not act on it, but a later snapshot
+// may still contain it
+func (s *Store) append(record JournalRecord) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		fmt.Println("WARNING, store: Store is closed ==> Record", record.Op, "dropped")
+		return false
+	}
+
+	// (1) Write the record
+	line, err := json.Marshal(record)
+	if !checkSuccessString("store, encoding journal record", err) {
+		return false
+	}
+
+	_, err = s.journal.Write(append(line, '\n'))
+	if !checkSuccessString("store, appending journal record", err) {
+		return false
+	}
+
+	s.apply(record)
+	s.records += 1
+	s.written += 1
+	ticket := s.written
+
+	if s.snapshotEvery > 0 && s.records >= s.snapshotEvery {
+		// NOTE: A failed snapshot only means a longer journal to replay, the record is synced below then
+		if checkSuccessString("store, taking snapshot", s.snapshot()) {
+			s.synced = s.written
+		}
+	}
+
+	// (2) Wait until a sync covers the record. The first waiting append syncs for all records written so far, the others wait for it
+	for s.synced < ticket {
+		if ticket <= s.failedUpTo {
+			return false
+		}
+		if s.syncing {
+			s.syncDone.Wait()
+			continue
+		}
+
+		s.syncing = true
+		target := s.written
+		s.mu.Unlock()
+		err = s.journal.Sync()
+		s.mu.Lock()
+		s.syncing = false
+
+		if err == nil && target > s.synced {
+			s.synced = target
+		} else if err != nil {
+			s.failedUpTo = target
+		}
+		s.syncDone.Broadcast()
+		if !checkSuccessString("store, syncing journal", err) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Makes the device's current state durable. Returns false if it could not be written, in which case nothing depending on it may be sent
+func (s *Store) putDevice(devState *DeviceState) bool {
+	if s == nil {
+		return true
+	}
+
+	device := persistDevice(devState)
+	return s.append(JournalRecord{Op: RECORD_DEVICE, Device: &device})
+}
+
+func (s *Store) deleteDevice(devId uint32) bool {
+	if s == nil {
+		return true
+	}
+	return s.append(JournalRecord{Op: RECORD_DELETE, DevId: devId})
+}
+
+func (s *Store) putScan(scan Scan) bool {
+	if s == nil {
+		return true
+	}
+	return s.append(JournalRecord{Op: RECORD_SCAN, Scan: &scan})
+}
+
+func (s *Store) deleteScan(sPubGw [KEY_LEN]byte) bool {
+	if s == nil {
+		return true
+	}
+	return s.append(JournalRecord{Op: RECORD_UNSCAN, Scan: &Scan{SPubGW: sPubGw}})
+}
+
+func (s *Store) putQuarantine(devId uint32, until time.Time) bool {
+	if s == nil {
+		return true
+	}
+	return s.append(JournalRecord{Op: RECORD_QUARANTINE, DevId: devId, Until: &until})
+}
+
+func (s *Store) putDelegation(delegation Delegation) bool {
+	if s == nil {
+		return true
+	}
+	return s.append(JournalRecord{Op: RECORD_DELEGATE, Delegation: &delegation})
+}
+
+func (s *Store) deleteDelegation(id uint32) bool {
+	if s == nil {
+		return true
+	}
+	return s.append(JournalRecord{Op: RECORD_UNDELEGATE, Delegation: &Delegation{Id: id}})
+}
+
+// Returns a copy of the stored delegations and the next unused delegation ID. A nil store holds none
+func (s *Store) storedDelegations() ([]Delegation, uint32) {
+	if s == nil {
+		return nil, 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delegations := make([]Delegation, 0, len(s.delegations))
+	for _, delegation := range s.delegations {
+		delegations = append(delegations, delegation)
+	}
+	return delegations, s.nextDelegationId
+}
+
+// Returns a copy of the quarantined IDs. A nil store holds none
+func (s *Store) quarantined() map[uint32]time.Time {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	quarantine := make(map[uint32]time.Time, len(s.quarantine))
+	for devId, until := range s.quarantine {
+		quarantine[devId] = until
+	}
+	return quarantine
+}
+
+// Waits for the sync in progress, syncs what was written since and closes the journal, such that every append waiting for its sync succeeds.
+// Later appends fail, closing again does nothing. A nil store holds nothing
+func (s *Store) close() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	for s.syncing {
+		s.syncDone.Wait()
+	}
+	if checkSuccessString("store, syncing journal", s.journal.Sync()) {
+		s.synced = s.written
+	} else {
+		s.failedUpTo = s.written
+	}
+	checkSuccessString("store, closing journal", s.journal.Close())
+	s.closed = true
+	s.syncDone.Broadcast()
+}
+
+// Takes a snapshot right away, such that neither the journal nor the old snapshot keeps what was overwritten or deleted since, e.g. the keys
+// of a revoked device. Returns false if it failed, the old records then remain until the next snapshot. A nil store holds nothing
+func (s *Store) compact() bool {
+	if s == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || !checkSuccessString("store, compacting", s.snapshot()) {
+		return false
+	}
+	// Every record written so far is in the snapshot
+	s.synced = s.written
+	return true
+}
+
+// Writes the mirrored state to a new snapshot file, atomically replaces the old one and empties the journal. The caller must hold the lock
+func (s *Store) snapshot() error {
+	snapshot := StoreSnapshot{NextDevId: s.nextDevId, Devices: make([]PersistedDevice, 0, len(s.devices)), Scans: make([]Scan, 0, len(s.scans)), Quarantine: make(map[uint32]time.Time)}
+	for _, device := range s.devices {
+		snapshot.Devices = append(snapshot.Devices, device)
+	}
+	for _, scan := range s.scans {
+		snapshot.Scans = append(snapshot.Scans, scan)
+	}
+	for devId, until := range s.quarantine {
+		// Expired quarantines are dropped
+		if time.Now().Before(until) {
+			snapshot.Quarantine[devId] = until
+		} else {
+			delete(s.quarantine, devId)
+		}
+	}
+	snapshot.NextDelegationId = s.nextDelegationId
+	for id, delegation := range s.delegations {
+		// Expired delegations are dropped as well
+		if time.Now().Before(delegation.Expires) {
+			snapshot.Delegations = append(snapshot.Delegations, delegation)
+		} else {
+			delete(s.delegations, id)
+		}
+	}
+
+	raw, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	// (1) Write and sync the new snapshot next to the old one
+	path := filepath.Join(s.dir, STORE_SNAPSHOT_FILE)
+	tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(raw)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	// (2) Replace the old snapshot. NOTE: A crash before the journal is emptied replays it on top of the new snapshot, which changes nothing
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+
+	// (3) Empty the journal. NOTE: Synced, such that the records it held, e.g. destroyed keys, do not reappear after a crash
+	err = s.journal.Truncate(0)
+	if err == nil {
+		err = s.journal.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.journal.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	s.records = 0
+
+	fmt.Println("INFO, store: Took snapshot of", len(snapshot.Devices), "devices")
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const (
+	TEST_STORE_DEVICES = 16 // Devices written to the store from their own goroutines
+	TEST_STORE_PUTS    = 20 // Records per device
+)
+
+func testStore(t *testing.T, dir string, snapshotEvery int) *Store {
+	store, err := openStore(dir, snapshotEvery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.close)
+	return store
+}
+
+// Closes the store and opens it again, as after a restart, and returns the restored registry
+func reopenStore(t *testing.T, store *Store, snapshotEvery int) (*Store, *DeviceRegistry) {
+	store.close()
+	store = testStore(t, store.dir, snapshotEvery)
+
+	devices := newDeviceRegistry()
+	store.restore(devices, make(Scans))
+	return store, devices
+}
+
+func testKeys(devId uint32) Sessionkeys {
+	return Sessionkeys{K_gw_s: bytes.Repeat([]byte{byte(devId)}, 32), K_s_gw: bytes.Repeat([]byte{byte(devId) + 1}, 32)}
+}
+
+// Every device is written by its own goroutine, the odd ones are deleted in the end. Meant to be run with -race
+func TestStoreConcurrentReplay(t *testing.T) {
+	store := testStore(t, t.TempDir(), 0)
+
+	// (1) Write and delete the devices concurrently
+	var wg sync.WaitGroup
+	for devId := uint32(0); devId < TEST_STORE_DEVICES; devId++ {
+		wg.Add(1)
+		go func(devId uint32) {
+			defer wg.Done()
+			devState := DeviceState{Id: devId, Sesskeys: testKeys(devId), Paired: true}
+			for reqCnt := uint32(1); reqCnt <= TEST_STORE_PUTS; reqCnt++ {
+				devState.reqCnt = reqCnt
+				if !store.putDevice(&devState) {
+					t.Errorf("device %v, put %v failed", devId, reqCnt)
+					return
+				}
+			}
+			if devId%2 == 1 && !store.deleteDevice(devId) {
+				t.Errorf("device %v, delete failed", devId)
+			}
+		}(devId)
+	}
+	wg.Wait()
+
+	// (2) The replayed journal holds the last state of every remaining device
+	store, devices := reopenStore(t, store, 0)
+	if devices.count() != TEST_STORE_DEVICES/2 {
+		t.Fatalf("%v devices, expected %v", devices.count(), TEST_STORE_DEVICES/2)
+	}
+	for devId := uint32(0); devId < TEST_STORE_DEVICES; devId++ {
+		devState, exists := devices.get(devId)
+		if exists != (devId%2 == 0) {
+			t.Errorf("device %v: exists %v after replay", devId, exists)
+			continue
+		}
+		if exists && (devState.reqCnt != TEST_STORE_PUTS || !bytes.Equal(devState.Sesskeys.K_gw_s, testKeys(devId).K_gw_s)) {
+			t.Errorf("device %v: reqCnt %v, keys %x after replay", devId, devState.reqCnt, devState.Sesskeys.K_gw_s)
+		}
+	}
+
+	// (3) Deleted IDs are not handed out again by the sequential allocation
+	if store.nextDevId != TEST_STORE_DEVICES {
+		t.Errorf("next device ID %v, expected %v", store.nextDevId, TEST_STORE_DEVICES)
+	}
+}
+
+func TestStoreSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	store := testStore(t, dir, 5)
+	revoked := DeviceState{Id: 1, Sesskeys: testKeys(1), Paired: true}
+	kept := DeviceState{Id: 2, Sesskeys: testKeys(2), Paired: true}
+
+	// (1) Every fifth record takes a snapshot and empties the journal
+	for reqCnt := uint32(1); reqCnt <= 7; reqCnt++ {
+		revoked.reqCnt, kept.reqCnt = reqCnt, reqCnt
+		if !store.putDevice(&revoked) || !store.putDevice(&kept) {
+			t.Fatalf("put %v failed", reqCnt)
+		}
+	}
+	if store.records != 4 {
+		t.Errorf("%v journal records after 14 puts, expected 4", store.records)
+	}
+
+	// (2) Compacting after the keys are destroyed leaves them in neither file
+	revoked.Status, revoked.Sesskeys = DEVICE_REVOKED, Sessionkeys{}
+	if !store.putDevice(&revoked) || !store.compact() {
+		t.Fatal("revocation not compacted")
+	}
+	for _, name := range []string{STORE_SNAPSHOT_FILE, STORE_JOURNAL_FILE} {
+		raw, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, []byte(`"kGwS":"AQEB`)) {
+			t.Errorf("%v still holds the keys of the revoked device", name)
+		}
+	}
+
+	// (3) Snapshot and journal restore the same state
+	_, devices := reopenStore(t, store, 5)
+	devState, _ := devices.get(1)
+	if devState.Status != DEVICE_REVOKED || devState.Sesskeys.K_gw_s != nil {
+		t.Errorf("revoked device: status %v, keys %x", devState.Status, devState.Sesskeys.K_gw_s)
+	}
+	devState, _ = devices.get(2)
+	if devState.reqCnt != 7 || !bytes.Equal(devState.Sesskeys.K_s_gw, testKeys(2).K_s_gw) {
+		t.Errorf("kept device: reqCnt %v, keys %x", devState.reqCnt, devState.Sesskeys.K_s_gw)
+	}
+}
+
+func TestStoreTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	store := testStore(t, dir, 0)
+	devState := DeviceState{Id: 1, Sesskeys: testKeys(1), Paired: true}
+	devState.reqCnt = 3
+	if !store.putDevice(&devState) {
+		t.Fatal("put failed")
+	}
+	store.close()
+
+	// (1) A crash interrupted the write of the next record
+	path := filepath.Join(dir, STORE_JOURNAL_FILE)
+	journal, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Write([]byte(`{"op":"device","device":{"id":1,"reqCnt":4`))
+	journal.Close()
+
+	// (2) The torn record is cut off and the complete one is kept
+	store, devices := reopenStore(t, store, 0)
+	devState, exists := devices.get(1)
+	if !exists || devState.reqCnt != 3 {
+		t.Fatalf("device exists %v, reqCnt %v after cutting off the torn record", exists, devState.reqCnt)
+	}
+
+	// (3) Later records are appended after the complete one and replay
+	devState.reqCnt = 5
+	if !store.putDevice(&devState) {
+		t.Fatal("put after the torn record failed")
+	}
+	_, devices = reopenStore(t, store, 0)
+	devState, _ = devices.get(1)
+	if devState.reqCnt != 5 {
+		t.Errorf("reqCnt %v, expected 5", devState.reqCnt)
+	}
+}
+
+// Appends from many goroutines share the syncs, every append returns once a sync covers its record
+func TestStoreGroupCommit(t *testing.T) {
+	store := testStore(t, t.TempDir(), 0)
+
+	var wg sync.WaitGroup
+	for devId := uint32(0); devId < TEST_STORE_DEVICES; devId++ {
+		wg.Add(1)
+		go func(devId uint32) {
+			defer wg.Done()
+			devState := DeviceState{Id: devId}
+			for reqCnt := uint32(1); reqCnt <= TEST_STORE_PUTS; reqCnt++ {
+				devState.reqCnt = reqCnt
+				if !store.putDevice(&devState) {
+					t.Errorf("device %v, put %v failed", devId, reqCnt)
+					return
+				}
+
+				store.mu.Lock()
+				synced, written := store.synced, store.written
+				store.mu.Unlock()
+				if synced > written {
+					t.Errorf("%v records synced, only %v written", synced, written)
+				}
+			}
+		}(devId)
+	}
+	wg.Wait()
+
+	if store.written != TEST_STORE_DEVICES*TEST_STORE_PUTS || store.synced != store.written || store.failedUpTo != 0 {
+		t.Errorf("written %v, synced %v, failed up to %v", store.written, store.synced, store.failedUpTo)
+	}
+
+	// Once closed, appends fail rather than being lost silently
+	store.close()
+	if store.putDevice(&DeviceState{Id: 0}) {
+		t.Error("append after closing succeeded")
+	}
+}